@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/qulia/go-message/message"
+	"github.com/streadway/amqp"
+)
+
+func runCount(g *globalFlags, args []string) error {
+	fs := newFlagSet("count")
+	queue := fs.String("queue", "", "queue to inspect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *queue == "" {
+		return errors.New("-queue is required")
+	}
+	admin, err := message.NewAdmin(g.url, g.options()...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	q, err := admin.QueueInspect(*queue)
+	if err != nil {
+		return err
+	}
+	return printResult(g, map[string]interface{}{
+		"queue":     q.Name,
+		"messages":  q.Messages,
+		"consumers": q.Consumers,
+	}, "%d messages, %d consumers\n", q.Messages, q.Consumers)
+}
+
+func runPurge(g *globalFlags, args []string) error {
+	fs := newFlagSet("purge")
+	queue := fs.String("queue", "", "queue to purge")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *queue == "" {
+		return errors.New("-queue is required")
+	}
+	admin, err := message.NewAdmin(g.url, g.options()...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	purged, err := admin.QueuePurge(*queue)
+	if err != nil {
+		return err
+	}
+	return printResult(g, map[string]interface{}{
+		"queue":  *queue,
+		"purged": purged,
+	}, "purged %d messages\n", purged)
+}
+
+func runDeclare(g *globalFlags, args []string) error {
+	fs := newFlagSet("declare")
+	queue := fs.String("queue", "", "queue to declare")
+	exchange := fs.String("exchange", "", "exchange to declare")
+	kind := fs.String("kind", "fanout", "exchange kind: fanout, direct, topic or headers")
+	durable := fs.Bool("durable", false, "survive broker restarts")
+	autoDelete := fs.Bool("auto-delete", false, "delete when no longer used")
+	arguments := headerFlags{}
+	fs.Var(arguments, "arg", "declare argument as key=value, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*queue == "") == (*exchange == "") {
+		return errors.New("exactly one of -queue and -exchange is required")
+	}
+	admin, err := message.NewAdmin(g.url, g.options()...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	if *exchange != "" {
+		err = admin.ExchangeDeclare(*exchange, *kind, *durable, *autoDelete, amqp.Table(arguments))
+		if err != nil {
+			return err
+		}
+		return printResult(g, map[string]interface{}{
+			"exchange": *exchange,
+			"kind":     *kind,
+		}, "declared %s exchange %s\n", *kind, *exchange)
+	}
+
+	q, err := admin.QueueDeclare(*queue, *durable, *autoDelete, amqp.Table(arguments))
+	if err != nil {
+		return err
+	}
+	return printResult(g, map[string]interface{}{
+		"queue":     q.Name,
+		"messages":  q.Messages,
+		"consumers": q.Consumers,
+	}, "declared queue %s\n", q.Name)
+}
+
+func runBind(g *globalFlags, args []string) error {
+	fs := newFlagSet("bind")
+	queue := fs.String("queue", "", "queue to bind")
+	destination := fs.String("destination", "", "exchange to bind instead of a queue")
+	exchange := fs.String("exchange", "", "source exchange")
+	key := fs.String("key", "", "routing key")
+	unbind := fs.Bool("unbind", false, "remove the binding instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *exchange == "" {
+		return errors.New("-exchange is required")
+	}
+	if (*queue == "") == (*destination == "") {
+		return errors.New("exactly one of -queue and -destination is required")
+	}
+	admin, err := message.NewAdmin(g.url, g.options()...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	target := *queue
+	switch {
+	case *queue != "" && *unbind:
+		err = admin.QueueUnbind(*queue, *key, *exchange, nil)
+	case *queue != "":
+		err = admin.QueueBind(*queue, *key, *exchange, nil)
+	case *unbind:
+		target = *destination
+		err = admin.ExchangeUnbind(*destination, *key, *exchange, nil)
+	default:
+		target = *destination
+		err = admin.ExchangeBind(*destination, *key, *exchange, nil)
+	}
+	if err != nil {
+		return err
+	}
+	action := "bound"
+	if *unbind {
+		action = "unbound"
+	}
+	return printResult(g, map[string]interface{}{
+		action:     target,
+		"exchange": *exchange,
+		"key":      *key,
+	}, "%s %s to %s\n", action, target, *exchange)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestHeaderFlags(t *testing.T) {
+	h := headerFlags{}
+	if err := h.Set("trace-id=abc=def"); err != nil {
+		t.Fatal(err)
+	}
+	if h["trace-id"] != "abc=def" {
+		t.Errorf("unexpected header value %v", h["trace-id"])
+	}
+	for _, bad := range []string{"novalue", "=value"} {
+		if err := h.Set(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	body, err := readBody([]string{"from arg"}, "", strings.NewReader("from stdin"))
+	if err != nil || string(body) != "from arg" {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+	body, err = readBody(nil, "-", strings.NewReader("from stdin"))
+	if err != nil || string(body) != "from stdin" {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+	_, err = readBody([]string{"a"}, "file", nil)
+	if err == nil {
+		t.Error("expected error for argument and file")
+	}
+}
+
+func TestPrettyBody(t *testing.T) {
+	if got := prettyBody([]byte(`{"a":1}`)); got != "{\n  \"a\": 1\n}" {
+		t.Errorf("unexpected JSON body %q", got)
+	}
+	if got := prettyBody([]byte("plain")); got != "plain" {
+		t.Errorf("unexpected text body %q", got)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	stops := 0
+	l := &limiter{limit: 2, handle: func(*amqp.Delivery) error { return nil }, stop: func() { stops++ }}
+	for i, expected := range []bool{true, true, false} {
+		// deliveries that are not handled are left unacked for the broker to requeue
+		if handled, err := l.offer(&amqp.Delivery{}); handled != expected || err != nil {
+			t.Errorf("delivery %d: handled %v %v, expected %v", i, handled, err, expected)
+		}
+	}
+	if stops != 1 || l.result(nil) != nil {
+		t.Errorf("expected one stop at the limit, got %d %v", stops, l.result(nil))
+	}
+
+	failed := errors.New("disk full")
+	stops = 0
+	l = &limiter{handle: func(*amqp.Delivery) error { return failed }, stop: func() { stops++ }}
+	// a failed delivery is nacked with requeue, the following ones are not handled
+	if handled, err := l.offer(&amqp.Delivery{}); handled || err != failed {
+		t.Errorf("unexpected result %v %v", handled, err)
+	}
+	if handled, err := l.offer(&amqp.Delivery{}); handled || err != nil {
+		t.Errorf("unexpected result after failure %v %v", handled, err)
+	}
+	if stops != 1 || l.result(nil) != failed {
+		t.Errorf("expected one stop and the handler error, got %d %v", stops, l.result(nil))
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/streadway/amqp"
+)
+
+// printResult writes result as a JSON line when -json is set, otherwise the formatted text
+func printResult(g *globalFlags, result map[string]interface{}, format string, args ...interface{}) error {
+	if g.json {
+		return json.NewEncoder(os.Stdout).Encode(result)
+	}
+	_, err := fmt.Printf(format, args...)
+	return err
+}
+
+// deliveryOutput is the JSON form of a delivery, Body is a string for UTF-8 bodies
+// and BodyBase64 otherwise
+type deliveryOutput struct {
+	Exchange        string                 `json:"exchange,omitempty"`
+	RoutingKey      string                 `json:"routing_key,omitempty"`
+	DeliveryTag     uint64                 `json:"delivery_tag"`
+	Redelivered     bool                   `json:"redelivered,omitempty"`
+	ContentType     string                 `json:"content_type,omitempty"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8                  `json:"delivery_mode,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+	CorrelationID   string                 `json:"correlation_id,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Expiration      string                 `json:"expiration,omitempty"`
+	MessageID       string                 `json:"message_id,omitempty"`
+	Timestamp       *time.Time             `json:"timestamp,omitempty"`
+	Type            string                 `json:"type,omitempty"`
+	UserID          string                 `json:"user_id,omitempty"`
+	AppID           string                 `json:"app_id,omitempty"`
+	Headers         map[string]interface{} `json:"headers,omitempty"`
+	Body            *string                `json:"body,omitempty"`
+	BodyBase64      []byte                 `json:"body_base64,omitempty"`
+}
+
+func newDeliveryOutput(d *amqp.Delivery) *deliveryOutput {
+	out := &deliveryOutput{
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+		DeliveryTag:     d.DeliveryTag,
+		Redelivered:     d.Redelivered,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationID:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageID:       d.MessageId,
+		Type:            d.Type,
+		UserID:          d.UserId,
+		AppID:           d.AppId,
+		Headers:         d.Headers,
+	}
+	if !d.Timestamp.IsZero() {
+		out.Timestamp = &d.Timestamp
+	}
+	if utf8.Valid(d.Body) {
+		body := string(d.Body)
+		out.Body = &body
+	} else {
+		out.BodyBase64 = d.Body
+	}
+	return out
+}
+
+// printDelivery prints a delivery as a JSON line or as properties followed by the pretty-printed body
+func printDelivery(g *globalFlags, w io.Writer, d *amqp.Delivery) {
+	out := newDeliveryOutput(d)
+	if g.json {
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	fmt.Fprintf(w, "--- delivery %d", d.DeliveryTag)
+	if d.Exchange != "" {
+		fmt.Fprintf(w, " from exchange %s", d.Exchange)
+	}
+	if d.RoutingKey != "" {
+		fmt.Fprintf(w, " routing key %s", d.RoutingKey)
+	}
+	fmt.Fprintln(w)
+	property := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%-17s %s\n", name+":", value)
+		}
+	}
+	property("content-type", d.ContentType)
+	property("content-encoding", d.ContentEncoding)
+	property("message-id", d.MessageId)
+	property("correlation-id", d.CorrelationId)
+	property("reply-to", d.ReplyTo)
+	property("expiration", d.Expiration)
+	property("type", d.Type)
+	property("user-id", d.UserId)
+	property("app-id", d.AppId)
+	if d.Priority != 0 {
+		property("priority", fmt.Sprint(d.Priority))
+	}
+	if d.Redelivered {
+		property("redelivered", "true")
+	}
+	if !d.Timestamp.IsZero() {
+		property("timestamp", d.Timestamp.Format(time.RFC3339))
+	}
+	keys := make([]string, 0, len(d.Headers))
+	for k := range d.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "header %s: %v\n", k, d.Headers[k])
+	}
+	fmt.Fprintf(w, "\n%s\n", prettyBody(d.Body))
+}
+
+// prettyBody indents JSON bodies, prints other UTF-8 bodies as is and hex dumps the rest
+func prettyBody(body []byte) string {
+	var buf bytes.Buffer
+	if json.Valid(body) && json.Indent(&buf, body, "", "  ") == nil {
+		return buf.String()
+	}
+	if utf8.Valid(body) {
+		return string(body)
+	}
+	return hex.Dump(body)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/qulia/go-message/message"
+	"github.com/streadway/amqp"
+)
+
+func runReceive(g *globalFlags, args []string) error {
+	return receive(g, "receive", args, 1)
+}
+
+func runTail(g *globalFlags, args []string) error {
+	return receive(g, "tail", args, 0)
+}
+
+// receive prints deliveries until limit messages are printed, 0 means until interrupted
+func receive(g *globalFlags, name string, args []string, defaultLimit int) error {
+	fs := newFlagSet(name)
+	queue := fs.String("queue", "", "queue to consume from, messages are acked so they are removed from the queue")
+	fanout := fs.String("fanout", "", "fanout exchange to listen on")
+	limit := fs.Int("n", defaultLimit, "number of messages to print before exiting, 0 for no limit")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: go-message " + name + " (-queue name | -fanout name) [flags]\n"))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return consume(g, *queue, *fanout, *limit, func(d *amqp.Delivery) error {
+		printDelivery(g, os.Stdout, d)
+		return nil
+	})
+}
+
+// consume calls handle for each delivery, one at a time, until limit deliveries are handled
+// or the process is interrupted, 0 means no limit
+// Queues and exchanges must exist, messages received from a queue are acked, so they are consumed
+func consume(g *globalFlags, queue, fanout string, limit int, handle func(*amqp.Delivery) error) error {
+	if (queue == "") == (fanout == "") {
+		return errors.New("exactly one of -queue and -fanout is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	l := &limiter{limit: limit, handle: handle, stop: stop}
+	opts := g.existing()
+
+	if fanout != "" {
+		message.NewReceiveFanoutManager(g.url, fanout, func(d *amqp.Delivery) {
+			l.offer(d)
+		}, opts...)
+		<-ctx.Done()
+		return l.result(nil)
+	}
+
+	if limit > 0 {
+		// the broker sends no more than the limit before the consumer is cancelled
+		opts = append(opts, message.WithPrefetch(limit))
+	}
+	rnqm, err := message.NewReceiveNamedQueueManager(g.url, queue, false, opts...)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		rnqm.ReceiveSettle(func(d *message.Delivery) error {
+			handled, err := l.offer(d.Delivery)
+			if !handled && err == nil {
+				// past the limit, left unacked so the broker requeues it when the consumer is closed
+				d.Defer()
+			}
+			return err
+		})
+		close(done)
+	}()
+	<-ctx.Done()
+	err = rnqm.Close()
+	<-done
+	return l.result(err)
+}
+
+// limiter hands deliveries to handle until limit are handled or handle fails, then calls stop
+type limiter struct {
+	mu      sync.Mutex
+	limit   int
+	handled int
+	err     error
+	handle  func(*amqp.Delivery) error
+	stop    func()
+}
+
+// offer returns whether the delivery was handled and the error of handle, it is neither handled
+// nor failed once the limit is reached or an earlier delivery failed
+func (l *limiter) offer(d *amqp.Delivery) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if (l.limit > 0 && l.handled >= l.limit) || l.err != nil {
+		return false, nil
+	}
+	if l.err = l.handle(d); l.err != nil {
+		l.stop()
+		return false, l.err
+	}
+	l.handled++
+	if l.limit > 0 && l.handled == l.limit {
+		l.stop()
+	}
+	return true, nil
+}
+
+// result is the error of handle, or err if every delivery was handled
+func (l *limiter) result(err error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	return err
+}
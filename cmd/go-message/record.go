@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/qulia/go-message/message"
+	"github.com/streadway/amqp"
+)
+
+func runRecord(g *globalFlags, args []string) error {
+	fs := newFlagSet("record")
+	queue := fs.String("queue", "", "queue to record, messages are acked so recording removes them from the queue")
+	fanout := fs.String("fanout", "", "fanout exchange to record")
+	output := fs.String("o", "-", "archive file, - for stdout")
+	format := fs.String("format", "jsonl", "archive format: jsonl or binary")
+	limit := fs.Int("n", 0, "number of messages to record before exiting, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	archiveFormat, err := parseArchiveFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	aw := message.NewArchiveWriter(w, archiveFormat)
+	recorded := 0
+	err = consume(g, *queue, *fanout, *limit, aw.RecordDelivery(func(*amqp.Delivery) error {
+		recorded++
+		return nil
+	}))
+	if flushErr := aw.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		return nil
+	}
+	return printResult(g, map[string]interface{}{
+		"recorded": recorded,
+		"file":     *output,
+	}, "recorded %d messages to %s\n", recorded, *output)
+}
+
+func runReplay(g *globalFlags, args []string) error {
+	fs := newFlagSet("replay")
+	queue := fs.String("queue", "", "queue to replay into")
+	fanout := fs.String("fanout", "", "fanout exchange to replay into")
+	input := fs.String("i", "-", "archive file, - for stdin")
+	format := fs.String("format", "jsonl", "archive format: jsonl or binary")
+	speed := fs.Float64("speed", message.ReplayOriginalPace,
+		"multiplier of the recorded pacing, 0 sends as fast as possible")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*queue == "") == (*fanout == "") {
+		return errors.New("exactly one of -queue and -fanout is required")
+	}
+	archiveFormat, err := parseArchiveFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var send func(*amqp.Publishing) error
+	if *fanout != "" {
+		sfm := message.NewSendFanoutManager(g.url, *fanout, g.existing()...)
+		defer sfm.Close()
+		send = sfm.Send
+	} else {
+		snqm, err := message.NewSendNamedQueueManager(g.url, *queue, g.existing()...)
+		if err != nil {
+			return err
+		}
+		defer snqm.Close()
+		send = snqm.SendPublishing
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	sent, err := message.Replay(ctx, message.NewArchiveReader(r, archiveFormat), *speed, send)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return printResult(g, map[string]interface{}{
+		"replayed": sent,
+		"queue":    *queue,
+		"fanout":   *fanout,
+	}, "replayed %d messages\n", sent)
+}
+
+func parseArchiveFormat(format string) (message.ArchiveFormat, error) {
+	switch format {
+	case "jsonl":
+		return message.ArchiveJSONL, nil
+	case "binary":
+		return message.ArchiveBinary, nil
+	}
+	return 0, fmt.Errorf("unknown archive format %q", format)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/qulia/go-message/message"
+	"github.com/streadway/amqp"
+)
+
+func runSend(g *globalFlags, args []string) error {
+	fs := newFlagSet("send")
+	queue := fs.String("queue", "", "queue to send to")
+	fanout := fs.String("fanout", "", "fanout exchange to send to")
+	file := fs.String("file", "", "read the body from the file, - for stdin")
+	contentType := fs.String("content-type", "text/plain", "content type of the body")
+	messageID := fs.String("message-id", "", "message ID")
+	headers := headerFlags{}
+	fs.Var(headers, "header", "header as key=value, can be repeated")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: go-message send (-queue name | -fanout name) [flags] [body]\n" +
+			"the body is read from the argument, -file or stdin\n"))
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*queue == "") == (*fanout == "") {
+		return errors.New("exactly one of -queue and -fanout is required")
+	}
+
+	body, err := readBody(fs.Args(), *file, os.Stdin)
+	if err != nil {
+		return err
+	}
+	msg := &amqp.Publishing{
+		ContentType: *contentType,
+		MessageId:   *messageID,
+		Timestamp:   time.Now(),
+		Body:        body,
+	}
+	if len(headers) > 0 {
+		msg.Headers = amqp.Table(headers)
+	}
+
+	if *fanout != "" {
+		sfm := message.NewSendFanoutManager(g.url, *fanout, g.existing()...)
+		defer sfm.Close()
+		err = sfm.Send(msg)
+	} else {
+		var snqm *message.SendNamedQueueManager
+		snqm, err = message.NewSendNamedQueueManager(g.url, *queue, g.existing()...)
+		if err != nil {
+			return err
+		}
+		defer snqm.Close()
+		err = snqm.SendPublishing(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return printResult(g, map[string]interface{}{
+		"sent":   true,
+		"queue":  *queue,
+		"fanout": *fanout,
+		"length": len(body),
+	}, "sent %d bytes\n", len(body))
+}
+
+// readBody takes the body from the single argument, the file or stdin in that order
+func readBody(args []string, file string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case len(args) > 1:
+		return nil, errors.New("only one body argument is allowed")
+	case len(args) == 1 && file != "":
+		return nil, errors.New("body argument and -file cannot be used together")
+	case len(args) == 1:
+		return []byte(args[0]), nil
+	case file != "" && file != "-":
+		return os.ReadFile(file)
+	default:
+		return io.ReadAll(stdin)
+	}
+}
@@ -1,8 +1,14 @@
 module github.com/qulia/go-message
 
-go 1.13
+go 1.22
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/qulia/go-log v0.0.0-20190817043825-bec210c0afad
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+	go.uber.org/zap v1.27.0
+	golang.org/x/time v0.9.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require go.uber.org/multierr v1.10.0 // indirect
@@ -0,0 +1,176 @@
+package message
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WithAckBatch makes the named queue receivers ack with multiple=true once size acks are pending
+// or every interval, instead of one round trip per message
+// Deliveries still in the handler are never covered, acks above the oldest of them are sent one by one
+// Delivery.Ack returns before the ack is sent, failures are logged
+func WithAckBatch(size int, interval time.Duration) Option {
+	return func(o *options) {
+		if size < 1 || interval <= 0 {
+			o.setErr(errors.New("ack batch needs a size of at least 1 and a positive interval"))
+			return
+		}
+		o.ackBatchSize = size
+		o.ackBatchInterval = interval
+	}
+}
+
+// ackBatcher coalesces the acks of one channel, delivery tags grow by one per delivery
+type ackBatcher struct {
+	// mu guards the tags, sending serializes the acks so a multiple ack never covers a tag
+	// another flush is about to ack on its own
+	mu       sync.Mutex
+	sending  sync.Mutex
+	ack      func(tag uint64, multiple bool) error
+	size     int
+	inFlight map[uint64]struct{}
+	pending  map[uint64]func()
+	done     chan struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	options  *options
+	keyvals  []interface{}
+}
+
+func newAckBatcher(ack func(tag uint64, multiple bool) error, o *options, keyvals ...interface{}) *ackBatcher {
+	b := &ackBatcher{
+		ack:      ack,
+		size:     o.ackBatchSize,
+		inFlight: map[uint64]struct{}{},
+		pending:  map[uint64]func(){},
+		done:     make(chan struct{}),
+		options:  o,
+		keyvals:  keyvals,
+	}
+	b.wg.Add(1)
+	go b.run(o.ackBatchInterval)
+	return b
+}
+
+func (b *ackBatcher) run(interval time.Duration) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+// received records a delivery handed to the handler
+func (b *ackBatcher) received(tag uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight[tag] = struct{}{}
+}
+
+// settled records a delivery nacked or rejected on its own, call it after the nack is sent
+// so a later multiple ack cannot cover it
+func (b *ackBatcher) settled(tag uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.inFlight, tag)
+}
+
+// add queues the ack of a delivery, acked runs once the broker got the ack
+// After close nothing flushes anymore, so the ack is sent right away
+func (b *ackBatcher) add(tag uint64, acked func()) {
+	b.mu.Lock()
+	delete(b.inFlight, tag)
+	b.pending[tag] = acked
+	full := len(b.pending) >= b.size || b.closed
+	b.mu.Unlock()
+	if full {
+		b.flush()
+	}
+}
+
+// flush acks the pending tags below the oldest delivery in the handler with one multiple ack
+// and the others one by one, the acks are sent and the callbacks run without holding mu
+func (b *ackBatcher) flush() {
+	b.sending.Lock()
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		b.sending.Unlock()
+		return
+	}
+	oldest := ^uint64(0)
+	for tag := range b.inFlight {
+		if tag < oldest {
+			oldest = tag
+		}
+	}
+	pending := b.pending
+	b.pending = map[uint64]func(){}
+	b.mu.Unlock()
+
+	tags := make([]uint64, 0, len(pending))
+	for tag := range pending {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	// deliveries received later have higher tags, so the batch is still below them
+	var acked []func()
+	covered := sort.Search(len(tags), func(i int) bool { return tags[i] > oldest })
+	if covered > 0 {
+		acked = b.sent(acked, pending, tags[:covered], b.ack(tags[covered-1], true))
+	}
+	for _, tag := range tags[covered:] {
+		acked = b.sent(acked, pending, []uint64{tag}, b.ack(tag, false))
+	}
+	b.sending.Unlock()
+	for _, f := range acked {
+		f()
+	}
+}
+
+// sent appends the callbacks of the tags the broker got to acked
+func (b *ackBatcher) sent(acked []func(), pending map[uint64]func(), tags []uint64, err error) []func() {
+	if err != nil {
+		b.options.logger.Error("Cannot ACK the messages", append(b.keyvals,
+			FieldDeliveryTag, tags[len(tags)-1], FieldCount, len(tags), FieldError, err)...)
+		return acked
+	}
+	for _, tag := range tags {
+		if f := pending[tag]; f != nil {
+			acked = append(acked, f)
+		}
+	}
+	return acked
+}
+
+// close stops the flush interval and sends the pending acks
+func (b *ackBatcher) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	closed := b.closed
+	b.closed = true
+	b.mu.Unlock()
+	if closed {
+		return
+	}
+	close(b.done)
+	b.wg.Wait()
+	b.flush()
+}
@@ -0,0 +1,142 @@
+package message
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAckBatchOutOfOrder(t *testing.T) {
+	var sent []string
+	o := newOptions([]Option{WithAckBatch(100, time.Hour)})
+	b := newAckBatcher(func(tag uint64, multiple bool) error {
+		sent = append(sent, fmt.Sprintf("%d %v", tag, multiple))
+		return nil
+	}, o)
+	defer b.close()
+
+	for tag := uint64(1); tag <= 6; tag++ {
+		b.received(tag)
+	}
+	var acked []uint64
+	ack := func(tag uint64) {
+		b.add(tag, func() { acked = append(acked, tag) })
+	}
+	// 3 is still in the handler, 4 was nacked on its own
+	ack(2)
+	ack(1)
+	ack(5)
+	b.settled(4)
+	ack(6)
+	b.flush()
+	if fmt.Sprint(sent) != "[2 true 5 false 6 false]" {
+		t.Fatalf("unexpected acks %v", sent)
+	}
+	if len(acked) != 4 {
+		t.Fatalf("expected the callbacks of the 4 acked tags, got %v", acked)
+	}
+
+	// once 3 is done everything up to 8 is covered by one ack
+	sent = nil
+	b.received(7)
+	b.received(8)
+	ack(8)
+	ack(3)
+	ack(7)
+	b.flush()
+	if fmt.Sprint(sent) != "[8 true]" {
+		t.Fatalf("unexpected acks %v", sent)
+	}
+}
+
+func TestAckBatchFlushesWhenFull(t *testing.T) {
+	sent := make(chan uint64, 10)
+	o := newOptions([]Option{WithAckBatch(3, time.Hour)})
+	b := newAckBatcher(func(tag uint64, multiple bool) error {
+		sent <- tag
+		return nil
+	}, o)
+	defer b.close()
+	for tag := uint64(1); tag <= 3; tag++ {
+		b.received(tag)
+		b.add(tag, nil)
+	}
+	select {
+	case tag := <-sent:
+		if tag != 3 {
+			t.Fatalf("expected one ack up to 3, got %d", tag)
+		}
+	default:
+		t.Fatal("expected a flush once the batch is full")
+	}
+}
+
+func TestAckBatchInterval(t *testing.T) {
+	sent := make(chan uint64, 10)
+	o := newOptions([]Option{WithAckBatch(100, 10*time.Millisecond)})
+	b := newAckBatcher(func(tag uint64, multiple bool) error {
+		sent <- tag
+		return nil
+	}, o)
+	defer b.close()
+	b.received(1)
+	b.add(1, nil)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected a flush after the interval")
+	}
+	if o := newOptions([]Option{WithAckBatch(0, time.Second)}); o.err == nil {
+		t.Fatal("expected an error for an empty batch")
+	}
+}
+
+func TestAckBatchAfterClose(t *testing.T) {
+	var sent []string
+	o := newOptions([]Option{WithAckBatch(100, time.Hour)})
+	b := newAckBatcher(func(tag uint64, multiple bool) error {
+		sent = append(sent, fmt.Sprintf("%d %v", tag, multiple))
+		return nil
+	}, o)
+	b.received(1)
+	b.received(2)
+	b.add(1, nil)
+	b.close()
+	// a handler still running when the receiver closes acks afterwards
+	b.add(2, nil)
+	b.close()
+	if fmt.Sprint(sent) != "[1 true 2 true]" {
+		t.Fatalf("unexpected acks %v", sent)
+	}
+}
+
+func TestAckBatchFlushUnlocked(t *testing.T) {
+	o := newOptions([]Option{WithAckBatch(100, time.Hour)})
+	var b *ackBatcher
+	b = newAckBatcher(func(tag uint64, multiple bool) error {
+		// a delivery arriving while the ack is sent
+		b.received(tag + 1)
+		return nil
+	}, o)
+	defer b.close()
+	b.received(1)
+	acked := false
+	b.add(1, func() {
+		// a callback settling another delivery
+		b.add(2, nil)
+		acked = true
+	})
+	done := make(chan struct{})
+	go func() {
+		b.flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush held the lock while acking")
+	}
+	if !acked {
+		t.Fatal("expected the callback to run")
+	}
+}
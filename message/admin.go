@@ -0,0 +1,140 @@
+package message
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Admin offers queue and exchange administration, every operation runs on its own channel
+// so a failed operation (which closes the channel on the broker) does not affect the next one
+type Admin struct {
+	conn    *amqp.Connection
+	options *options
+}
+
+// NewAdmin connects to the server for administration
+func NewAdmin(serverAddress string, opts ...Option) (*Admin, error) {
+	a := new(Admin)
+	a.options = newOptions(opts)
+	if a.options.err != nil {
+		return nil, a.options.err
+	}
+	conn, err := a.options.dial(serverAddress)
+	if err != nil {
+		a.options.logger.Error("Failed to connect to RabbitMQ", FieldError, err)
+		return nil, err
+	}
+	a.conn = conn
+	return a, nil
+}
+
+// QueueDeclare declares the queue, an existing queue must have matching arguments
+func (a *Admin) QueueDeclare(name string, durable, autoDelete bool, args amqp.Table) (amqp.Queue, error) {
+	var q amqp.Queue
+	err := a.withChannel("Failed to declare a queue", []interface{}{FieldQueue, name}, func(ch *amqp.Channel) error {
+		var err error
+		q, err = ch.QueueDeclare(name, durable, autoDelete, false, false, args)
+		return brokerError(err, args)
+	})
+	return q, err
+}
+
+// QueueInspect passively looks up the queue, Messages and Consumers hold the current counts
+// Returns an error if the queue does not exist
+func (a *Admin) QueueInspect(name string) (amqp.Queue, error) {
+	var q amqp.Queue
+	err := a.withChannel("Failed to inspect queue", []interface{}{FieldQueue, name}, func(ch *amqp.Channel) error {
+		var err error
+		q, err = ch.QueueInspect(name)
+		return err
+	})
+	return q, err
+}
+
+// QueuePurge removes all messages that are not awaiting ack, returns the number of purged messages
+func (a *Admin) QueuePurge(name string) (int, error) {
+	var count int
+	err := a.withChannel("Failed to purge queue", []interface{}{FieldQueue, name}, func(ch *amqp.Channel) error {
+		var err error
+		count, err = ch.QueuePurge(name, false)
+		return err
+	})
+	return count, err
+}
+
+// QueueDelete deletes the queue, returns the number of messages deleted with it
+// ifUnused and ifEmpty make the delete fail if the queue has consumers or messages
+func (a *Admin) QueueDelete(name string, ifUnused, ifEmpty bool) (int, error) {
+	var count int
+	err := a.withChannel("Failed to delete queue", []interface{}{FieldQueue, name}, func(ch *amqp.Channel) error {
+		var err error
+		count, err = ch.QueueDelete(name, ifUnused, ifEmpty, false)
+		return err
+	})
+	return count, err
+}
+
+// ExchangeDeclare declares an exchange of the given kind (fanout, direct, topic, headers)
+func (a *Admin) ExchangeDeclare(name, kind string, durable, autoDelete bool, args amqp.Table) error {
+	return a.withChannel("Failed to declare exchange", []interface{}{FieldExchange, name}, func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, autoDelete, false, false, args)
+	})
+}
+
+// ExchangeDelete deletes the exchange, ifUnused makes the delete fail if the exchange has bindings
+func (a *Admin) ExchangeDelete(name string, ifUnused bool) error {
+	return a.withChannel("Failed to delete exchange", []interface{}{FieldExchange, name}, func(ch *amqp.Channel) error {
+		return ch.ExchangeDelete(name, ifUnused, false)
+	})
+}
+
+// QueueBind binds the queue to the exchange with the routing key
+func (a *Admin) QueueBind(queue, key, exchange string, args amqp.Table) error {
+	return a.withChannel("Failed to bind queue", []interface{}{FieldQueue, queue, FieldExchange, exchange},
+		func(ch *amqp.Channel) error {
+			return ch.QueueBind(queue, key, exchange, false, args)
+		})
+}
+
+// QueueUnbind removes the binding between the queue and the exchange
+func (a *Admin) QueueUnbind(queue, key, exchange string, args amqp.Table) error {
+	return a.withChannel("Failed to unbind queue", []interface{}{FieldQueue, queue, FieldExchange, exchange},
+		func(ch *amqp.Channel) error {
+			return ch.QueueUnbind(queue, key, exchange, args)
+		})
+}
+
+// ExchangeBind routes messages from the source exchange to the destination exchange
+func (a *Admin) ExchangeBind(destination, key, source string, args amqp.Table) error {
+	return a.withChannel("Failed to bind exchange", []interface{}{FieldExchange, destination, FieldSourceExchange, source},
+		func(ch *amqp.Channel) error {
+			return ch.ExchangeBind(destination, key, source, false, args)
+		})
+}
+
+// ExchangeUnbind removes the binding between the source and destination exchanges
+func (a *Admin) ExchangeUnbind(destination, key, source string, args amqp.Table) error {
+	return a.withChannel("Failed to unbind exchange", []interface{}{FieldExchange, destination, FieldSourceExchange, source},
+		func(ch *amqp.Channel) error {
+			return ch.ExchangeUnbind(destination, key, source, false, args)
+		})
+}
+
+// Close the connection
+func (a *Admin) Close() error {
+	return brokerError(a.conn.Close(), nil)
+}
+
+func (a *Admin) withChannel(failMsg string, keyvals []interface{}, op func(ch *amqp.Channel) error) error {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		a.options.logger.Error("Failed to open a channel", FieldError, err)
+		return brokerError(err, nil)
+	}
+	err = brokerError(op(ch), nil)
+	if err != nil {
+		a.options.logger.Error(failMsg, append(keyvals, FieldError, err)...)
+		// the broker already closed the channel on failure
+		return err
+	}
+	return ch.Close()
+}
@@ -0,0 +1,74 @@
+// Integration tests for queue and exchange administration
+package message
+
+import (
+	"testing"
+)
+
+func TestAdminQueueLifecycle(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+	admin, err := NewAdmin(serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	exchange := t.Name() + "Exchange"
+	err = admin.ExchangeDeclare(exchange, "fanout", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = admin.QueueBind(t.Name(), "", exchange, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nqs, _ := NewSendNamedQueueManager(serverAddress, t.Name())
+	for i := 0; i < 3; i++ {
+		err = nqs.Send([]byte("message"))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	nqs.Close()
+	waitExpectedCount(t.Name(), 3)
+
+	q, err := admin.QueueInspect(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != 3 || q.Consumers != 0 {
+		t.Errorf("Unexpected messages/consumers %d/%d", q.Messages, q.Consumers)
+	}
+
+	// Queue is not empty
+	_, err = admin.QueueDelete(t.Name(), false, true)
+	if err == nil {
+		t.Error("Expected delete with ifEmpty to fail")
+	}
+
+	purged, err := admin.QueuePurge(t.Name())
+	if err != nil || purged != 3 {
+		t.Errorf("Unexpected purge result %d %v", purged, err)
+	}
+
+	err = admin.QueueUnbind(t.Name(), "", exchange, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	err = admin.ExchangeDelete(exchange, false)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = admin.QueueDelete(t.Name(), false, true)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = admin.QueueInspect(t.Name())
+	if err == nil {
+		t.Error("Expected inspect of deleted queue to fail")
+	}
+}
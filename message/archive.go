@@ -0,0 +1,493 @@
+package message
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ArchiveFormat selects how records are written to an archive
+type ArchiveFormat int
+
+const (
+	// ArchiveJSONL writes one JSON record per line, header values keep their AMQP types
+	ArchiveJSONL ArchiveFormat = iota
+	// ArchiveBinary writes a gob stream, smaller and faster than JSONL
+	ArchiveBinary
+)
+
+// Replay speeds
+const (
+	// ReplayAsFastAsPossible sends the records without waiting
+	ReplayAsFastAsPossible = 0
+	// ReplayOriginalPace keeps the time between records as they were received
+	ReplayOriginalPace = 1
+)
+
+// Record is a received message with all its properties as stored in an archive
+type Record struct {
+	ReceivedAt      time.Time  `json:"received_at"`
+	Exchange        string     `json:"exchange,omitempty"`
+	RoutingKey      string     `json:"routing_key,omitempty"`
+	Headers         amqp.Table `json:"-"`
+	ContentType     string     `json:"content_type,omitempty"`
+	ContentEncoding string     `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8      `json:"delivery_mode,omitempty"`
+	Priority        uint8      `json:"priority,omitempty"`
+	CorrelationId   string     `json:"correlation_id,omitempty"`
+	ReplyTo         string     `json:"reply_to,omitempty"`
+	Expiration      string     `json:"expiration,omitempty"`
+	MessageId       string     `json:"message_id,omitempty"`
+	Timestamp       time.Time  `json:"timestamp"`
+	Type            string     `json:"type,omitempty"`
+	UserId          string     `json:"user_id,omitempty"`
+	AppId           string     `json:"app_id,omitempty"`
+	Body            []byte     `json:"body"`
+}
+
+// NewRecord copies the delivery into a record received now
+func NewRecord(d *amqp.Delivery) *Record {
+	return &Record{
+		ReceivedAt:      time.Now(),
+		Exchange:        d.Exchange,
+		RoutingKey:      d.RoutingKey,
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// publishingRecord copies a message to send into a record created now
+func publishingRecord(p *amqp.Publishing) *Record {
+	return &Record{
+		ReceivedAt:      time.Now(),
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		Body:            p.Body,
+	}
+}
+
+// Publishing returns the record as a message to send
+func (r *Record) Publishing() *amqp.Publishing {
+	return &amqp.Publishing{
+		Headers:         r.Headers,
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Timestamp:       r.Timestamp,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+		Body:            r.Body,
+	}
+}
+
+// jsonRecord adds the typed headers to the JSON form of Record
+type jsonRecord struct {
+	*Record
+	Headers map[string]*typedValue `json:"headers,omitempty"`
+}
+
+// marshalRecord is the JSON form of the record written to JSONL archives, without the newline
+func marshalRecord(r *Record) ([]byte, error) {
+	headers, err := typedTable(r.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonRecord{Record: r, Headers: headers})
+}
+
+// unmarshalRecord reverses marshalRecord
+func unmarshalRecord(data []byte) (*Record, error) {
+	r := new(Record)
+	jr := &jsonRecord{Record: r}
+	if err := json.Unmarshal(data, jr); err != nil {
+		return nil, err
+	}
+	var err error
+	r.Headers, err = untypedTable(jr.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ArchiveWriter writes records to an archive, safe for concurrent use
+// so Write can be called directly from the receive callbacks
+type ArchiveWriter struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	format ArchiveFormat
+	gob    *gob.Encoder
+	// err is the first failed write of a RecordFanout handler
+	err error
+}
+
+// NewArchiveWriter creates a writer, Flush must be called when done
+func NewArchiveWriter(w io.Writer, format ArchiveFormat) *ArchiveWriter {
+	aw := &ArchiveWriter{w: bufio.NewWriter(w), format: format}
+	if format == ArchiveBinary {
+		aw.gob = gob.NewEncoder(aw.w)
+	}
+	return aw
+}
+
+// Write appends the delivery to the archive
+func (aw *ArchiveWriter) Write(d *amqp.Delivery) error {
+	return aw.WriteRecord(NewRecord(d))
+}
+
+// WriteRecord appends the record to the archive
+func (aw *ArchiveWriter) WriteRecord(r *Record) error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if aw.format == ArchiveBinary {
+		return aw.gob.Encode(r)
+	}
+	data, err := marshalRecord(r)
+	if err != nil {
+		return err
+	}
+	_, err = aw.w.Write(append(data, '\n'))
+	return err
+}
+
+// Flush writes buffered records to the underlying writer, it also returns the first write
+// that failed in a RecordFanout handler
+func (aw *ArchiveWriter) Flush() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if err := aw.w.Flush(); err != nil {
+		return err
+	}
+	return aw.err
+}
+
+// RecordDelivery returns a ReceiveNamedQueueManager.ReceiveDelivery handler that writes each
+// delivery to the archive and then calls next, a failed write is returned so the delivery is
+// requeued and next is not called, next may be nil
+func (aw *ArchiveWriter) RecordDelivery(next func(*amqp.Delivery) error) func(*amqp.Delivery) error {
+	return func(d *amqp.Delivery) error {
+		if err := aw.Write(d); err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		return next(d)
+	}
+}
+
+// RecordFanout returns a NewReceiveFanoutManager handler that writes each delivery to the archive
+// and then calls next, which may be nil. Fanout deliveries cannot be requeued, so a failed write is
+// kept for Flush and next is still called
+func (aw *ArchiveWriter) RecordFanout(next func(*amqp.Delivery)) func(*amqp.Delivery) {
+	return func(d *amqp.Delivery) {
+		if err := aw.Write(d); err != nil {
+			aw.mu.Lock()
+			if aw.err == nil {
+				aw.err = err
+			}
+			aw.mu.Unlock()
+		}
+		if next != nil {
+			next(d)
+		}
+	}
+}
+
+// ArchiveReader reads records written by ArchiveWriter
+type ArchiveReader struct {
+	format ArchiveFormat
+	json   *json.Decoder
+	gob    *gob.Decoder
+}
+
+// NewArchiveReader creates a reader for an archive in the given format
+func NewArchiveReader(r io.Reader, format ArchiveFormat) *ArchiveReader {
+	ar := &ArchiveReader{format: format}
+	if format == ArchiveBinary {
+		ar.gob = gob.NewDecoder(bufio.NewReader(r))
+	} else {
+		ar.json = json.NewDecoder(bufio.NewReader(r))
+	}
+	return ar
+}
+
+// Next returns the next record, io.EOF at the end of the archive
+func (ar *ArchiveReader) Next() (*Record, error) {
+	r := new(Record)
+	if ar.format == ArchiveBinary {
+		err := ar.gob.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	jr := &jsonRecord{Record: r}
+	err := ar.json.Decode(jr)
+	if err != nil {
+		return nil, err
+	}
+	r.Headers, err = untypedTable(jr.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Replay sends every record of the archive with send until the end of the archive or ctx is done
+// speed multiplies the original pacing, ReplayOriginalPace keeps it, ReplayAsFastAsPossible does not wait
+// send is typically SendNamedQueueManager.SendPublishing or SendFanoutManager.Send
+// Returns the number of records sent
+func Replay(ctx context.Context, ar *ArchiveReader, speed float64, send func(*amqp.Publishing) error) (int, error) {
+	if speed < 0 {
+		return 0, fmt.Errorf("invalid replay speed %v", speed)
+	}
+	sent := 0
+	var previous time.Time
+	for {
+		r, err := ar.Next()
+		if errors.Is(err, io.EOF) {
+			return sent, nil
+		}
+		if err != nil {
+			return sent, err
+		}
+		if speed != ReplayAsFastAsPossible && !previous.IsZero() {
+			wait := time.Duration(float64(r.ReceivedAt.Sub(previous)) / speed)
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return sent, ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		previous = r.ReceivedAt
+		if err := ctx.Err(); err != nil {
+			return sent, err
+		}
+		if err := send(r.Publishing()); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// typedValue keeps the AMQP type of a header value in JSON
+type typedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func typedTable(t amqp.Table) (map[string]*typedValue, error) {
+	if t == nil {
+		return nil, nil
+	}
+	res := make(map[string]*typedValue, len(t))
+	for k, v := range t {
+		tv, err := newTypedValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", k, err)
+		}
+		res[k] = tv
+	}
+	return res, nil
+}
+
+func untypedTable(t map[string]*typedValue) (amqp.Table, error) {
+	if t == nil {
+		return nil, nil
+	}
+	res := make(amqp.Table, len(t))
+	for k, tv := range t {
+		v, err := tv.value()
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %w", k, err)
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+func newTypedValue(v interface{}) (*typedValue, error) {
+	var typ string
+	switch fv := v.(type) {
+	case nil:
+		return &typedValue{Type: "nil"}, nil
+	case bool:
+		typ = "bool"
+	case int8:
+		typ = "int8"
+	case uint8:
+		typ = "uint8"
+	case int16:
+		typ = "int16"
+	case int32:
+		typ = "int32"
+	case int:
+		typ = "int"
+	case int64:
+		typ = "int64"
+	case float32:
+		typ = "float32"
+	case float64:
+		typ = "float64"
+	case string:
+		typ = "string"
+	case []byte:
+		typ = "bytes"
+	case amqp.Decimal:
+		typ = "decimal"
+	case time.Time:
+		typ = "time"
+	case amqp.Table:
+		t, err := typedTable(fv)
+		if err != nil {
+			return nil, err
+		}
+		v, typ = t, "table"
+	case []interface{}:
+		a := make([]*typedValue, len(fv))
+		for i, item := range fv {
+			tv, err := newTypedValue(item)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = tv
+		}
+		v, typ = a, "array"
+	default:
+		return nil, fmt.Errorf("unsupported header type %T", v)
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &typedValue{Type: typ, Value: raw}, nil
+}
+
+func (tv *typedValue) value() (interface{}, error) {
+	var err error
+	switch tv.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		var v bool
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int8":
+		var v int8
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "uint8":
+		var v uint8
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int16":
+		var v int16
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int32":
+		var v int32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int":
+		var v int
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "int64":
+		var v int64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float32":
+		var v float32
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "float64":
+		var v float64
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "string":
+		var v string
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "decimal":
+		var v amqp.Decimal
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(tv.Value, &v)
+		return v, err
+	case "table":
+		var t map[string]*typedValue
+		if err = json.Unmarshal(tv.Value, &t); err != nil {
+			return nil, err
+		}
+		return untypedTable(t)
+	case "array":
+		var a []*typedValue
+		if err = json.Unmarshal(tv.Value, &a); err != nil {
+			return nil, err
+		}
+		res := make([]interface{}, len(a))
+		for i, item := range a {
+			if res[i], err = item.value(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unknown header type %q", tv.Type)
+}
+
+func init() {
+	// header values are stored as interface{} in the binary archive
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
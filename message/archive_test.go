@@ -0,0 +1,144 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	delivery := &amqp.Delivery{
+		Exchange:    "events",
+		ContentType: "application/json",
+		MessageId:   "m1",
+		Priority:    3,
+		Timestamp:   time.Unix(1600000000, 0).UTC(),
+		Headers: amqp.Table{
+			"count":   int32(5),
+			"big":     int64(1 << 40),
+			"ratio":   float64(0.5),
+			"name":    "value",
+			"raw":     []byte{0, 1, 2},
+			"when":    time.Unix(1600000000, 0).UTC(),
+			"nested":  amqp.Table{"flag": true},
+			"list":    []interface{}{"a", int16(2)},
+			"decimal": amqp.Decimal{Scale: 2, Value: 1234},
+		},
+		Body: []byte{0xff, 0x00, 'x'},
+	}
+
+	for _, format := range []ArchiveFormat{ArchiveJSONL, ArchiveBinary} {
+		var buf bytes.Buffer
+		aw := NewArchiveWriter(&buf, format)
+		if err := aw.Write(delivery); err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		ar := NewArchiveReader(&buf, format)
+		r, err := ar.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r.Headers, delivery.Headers) {
+			t.Errorf("format %d: headers %#v, expected %#v", format, r.Headers, delivery.Headers)
+		}
+		if !bytes.Equal(r.Body, delivery.Body) || r.MessageId != "m1" || r.Priority != 3 ||
+			!r.Timestamp.Equal(delivery.Timestamp) || r.Exchange != "events" {
+			t.Errorf("format %d: unexpected record %+v", format, r)
+		}
+		if _, err := ar.Next(); err != io.EOF {
+			t.Errorf("format %d: expected EOF, got %v", format, err)
+		}
+	}
+}
+
+func TestReplayPacing(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewArchiveWriter(&buf, ArchiveJSONL)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		aw.WriteRecord(&Record{ReceivedAt: start.Add(time.Duration(i) * 100 * time.Millisecond), Body: []byte{byte(i)}})
+	}
+	aw.Flush()
+	archive := buf.Bytes()
+
+	var bodies []byte
+	send := func(msg *amqp.Publishing) error {
+		bodies = append(bodies, msg.Body...)
+		return nil
+	}
+
+	begin := time.Now()
+	sent, err := Replay(context.Background(), NewArchiveReader(bytes.NewReader(archive), ArchiveJSONL), 2, send)
+	if err != nil || sent != 3 {
+		t.Fatalf("unexpected replay result %d %v", sent, err)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Errorf("replay at double speed took %v, expected at least 100ms", elapsed)
+	}
+	if !bytes.Equal(bodies, []byte{0, 1, 2}) {
+		t.Errorf("unexpected order %v", bodies)
+	}
+
+	begin = time.Now()
+	sent, err = Replay(context.Background(), NewArchiveReader(bytes.NewReader(archive), ArchiveJSONL),
+		ReplayAsFastAsPossible, send)
+	if err != nil || sent != 3 {
+		t.Fatalf("unexpected replay result %d %v", sent, err)
+	}
+	if elapsed := time.Since(begin); elapsed > 50*time.Millisecond {
+		t.Errorf("replay as fast as possible took %v", elapsed)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestArchiveRecordHandlers(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewArchiveWriter(&buf, ArchiveJSONL)
+	handled := 0
+	handle := aw.RecordDelivery(func(d *amqp.Delivery) error {
+		handled++
+		return nil
+	})
+	if err := handle(&amqp.Delivery{MessageId: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	aw.RecordFanout(nil)(&amqp.Delivery{MessageId: "m2"})
+	if err := aw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ar := NewArchiveReader(&buf, ArchiveJSONL)
+	for _, id := range []string{"m1", "m2"} {
+		if r, err := ar.Next(); err != nil || r.MessageId != id {
+			t.Fatalf("expected %s, got %v %v", id, r, err)
+		}
+	}
+	if handled != 1 {
+		t.Errorf("expected the handler to be called once, got %d", handled)
+	}
+
+	// bodies larger than the buffer reach the writer right away
+	large := &amqp.Delivery{Body: bytes.Repeat([]byte("x"), 8192)}
+	aw = NewArchiveWriter(failingWriter{}, ArchiveBinary)
+	if err := aw.RecordDelivery(nil)(large); err == nil {
+		t.Error("expected the failed write to be returned")
+	}
+	aw = NewArchiveWriter(failingWriter{}, ArchiveBinary)
+	called := false
+	aw.RecordFanout(func(*amqp.Delivery) { called = true })(large)
+	if err := aw.Flush(); err == nil || !called {
+		t.Errorf("expected the failed write from Flush and the handler to be called, got %v %v", err, called)
+	}
+}
@@ -0,0 +1,106 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BatchError is returned by a batch handler to settle every delivery by its own result,
+// Results[i] is the result of batch[i], nil acks and an error nacks with requeue
+type BatchError struct {
+	Results []error
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	for _, err := range e.Results {
+		if err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d messages failed", failed, len(e.Results))
+}
+
+// ReceiveBatch collects up to size deliveries, or what arrived within timeout of the first one, and calls
+// onBatch once per batch until the queue manager is closed
+// Deliveries onBatch did not settle or Defer are acked when it returns nil and nacked with requeue
+// when it returns an error, a *BatchError settles them one by one
+// The prefetch limits the batch size, WithWorkers does not apply, batches are handled one at a time
+func (rnqm *ReceiveNamedQueueManager) ReceiveBatch(size int, timeout time.Duration, onBatch func([]*Delivery) error) error {
+	if size < 1 || timeout <= 0 {
+		return errors.New("batch needs a size of at least 1 and a positive timeout")
+	}
+	options := rnqm.namedQueueManager.options
+	queueName := rnqm.namedQueueManager.queue.Name
+	if options.prefetch > 0 && options.prefetch < size {
+		options.logger.Warn("Prefetch is smaller than the batch size, batches are cut by the timeout",
+			FieldQueue, queueName, FieldCount, size)
+	}
+
+	active := false
+	var batch []*Delivery
+	var timer *time.Timer
+	var timeoutC <-chan time.Time
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, timeoutC = nil, nil
+		}
+		if len(batch) > 0 {
+			rnqm.handleBatch(batch, onBatch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-rnqm.msgs:
+			if !ok {
+				flush()
+				rnqm.stopped(active)
+				return nil
+			}
+			rnqm.received(&msg, &active)
+			options.waitReceive()
+			d := rnqm.decode(msg)
+			if d == nil {
+				continue
+			}
+			batch = append(batch, d)
+			if len(batch) == 1 {
+				timer = time.NewTimer(timeout)
+				timeoutC = timer.C
+			}
+			if len(batch) >= size {
+				flush()
+			}
+		case <-timeoutC:
+			timer, timeoutC = nil, nil
+			flush()
+		}
+	}
+}
+
+// handleBatch calls onBatch and settles the deliveries it left unsettled
+func (rnqm *ReceiveNamedQueueManager) handleBatch(batch []*Delivery, onBatch func([]*Delivery) error) {
+	logger := rnqm.namedQueueManager.options.logger
+	queueName := rnqm.namedQueueManager.queue.Name
+	err := onBatch(batch)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		if len(batchErr.Results) == len(batch) {
+			for i, d := range batch {
+				d.settleOnReturn(batchErr.Results[i])
+			}
+			return
+		}
+		logger.Error("Batch results do not match the batch, nacking the batch", FieldQueue, queueName,
+			FieldCount, len(batch), FieldError, err)
+	}
+	if err != nil {
+		logger.Warn("Batch handler failed", FieldQueue, queueName, FieldCount, len(batch), FieldError, err)
+	}
+	for _, d := range batch {
+		d.settleOnReturn(err)
+	}
+}
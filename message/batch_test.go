@@ -0,0 +1,50 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestReceiveBatch(t *testing.T) {
+	rnqm := newTestReceiver()
+	msgs := make(chan amqp.Delivery)
+	rnqm.msgs = msgs
+	ack := &recordingAcknowledger{}
+
+	var sizes []int
+	done := make(chan error)
+	go func() {
+		done <- rnqm.ReceiveBatch(2, 20*time.Millisecond, func(batch []*Delivery) error {
+			sizes = append(sizes, len(batch))
+			if len(sizes) == 2 {
+				// the second batch fails for its first message only
+				return &BatchError{Results: []error{errors.New("duplicate"), nil}}
+			}
+			return nil
+		})
+	}()
+	for tag := uint64(1); tag <= 5; tag++ {
+		msgs <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag, Body: []byte{byte(tag)}}
+	}
+	// the last message is handled alone once the timeout passes
+	time.Sleep(100 * time.Millisecond)
+	close(msgs)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Fatalf("unexpected batch sizes %v", sizes)
+	}
+	expected := "[ack 1 false ack 2 false nack 3 false true ack 4 false ack 5 false]"
+	if ack.String() != expected {
+		t.Fatalf("unexpected settlements %s", ack)
+	}
+	if err := rnqm.ReceiveBatch(0, time.Second, nil); err == nil {
+		t.Fatal("expected an error for an empty batch")
+	}
+}
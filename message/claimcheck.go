@@ -0,0 +1,222 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ClaimCheckHeader holds the blob key of a body moved to the BlobStore
+const ClaimCheckHeader = "x-claim-check"
+
+// ClaimDigestHeader holds the SHA-256 of the stored body, it is signed along with the key
+// so a body changed in the store fails verification
+const ClaimDigestHeader = "x-claim-check-sha256"
+
+// BlobStore keeps the bodies of oversized messages, implementations must be safe for concurrent use
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FileBlobStore stores blobs as files in a directory shared by senders and receivers
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates the directory if it does not exist
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put writes the blob, it becomes visible once it is completely written
+func (fs *FileBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fs.dir, ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the blob
+func (fs *FileBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Delete removes the blob, deleting a missing blob is not an error
+func (fs *FileBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Expire deletes blobs, and temporary files left by interrupted writes, last written more than ttl ago
+// and returns how many were deleted. Blobs of fanout messages are never deleted by receivers, call
+// Expire periodically with a ttl longer than any receiver may take to fetch them
+func (fs *FileBlobStore) Expire(ctx context.Context, ttl time.Duration) (int, error) {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-ttl)
+	deleted := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if !info.ModTime().Before(cutoff) {
+			continue
+		}
+		err = os.Remove(filepath.Join(fs.dir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (fs *FileBlobStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(fs.dir, key), nil
+}
+
+// WithClaimCheck moves bodies of at least threshold bytes to the store on send and publishes
+// a reference in ClaimCheckHeader instead, receivers fetch the body before the handler is called
+// Named queue receivers delete the blob once the message is acked. Blobs of rejected messages,
+// which may be dead-lettered, and of messages sent to fanouts, which have several receivers, are kept,
+// remove them with FileBlobStore.Expire or the store's own retention
+func WithClaimCheck(store BlobStore, threshold int) Option {
+	return func(o *options) {
+		o.blobs = store
+		o.claimThreshold = threshold
+	}
+}
+
+// WithClaimReleaseOnReject makes named queue receivers also delete the blob when the message is
+// rejected without requeue, use it only when the queue has no dead-letter exchange, neither from its
+// arguments nor from a broker policy, otherwise the dead-lettered message loses its body
+// It has no effect together with WithDeadLetterExchange
+func WithClaimReleaseOnReject() Option {
+	return func(o *options) {
+		o.releaseRejected = true
+	}
+}
+
+// checkClaim stores a large body and replaces it with a reference, headers are copied before they are changed
+func (o *options) checkClaim(msg *amqp.Publishing) error {
+	if o.blobs == nil || len(msg.Body) < o.claimThreshold {
+		return nil
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	key := hex.EncodeToString(id)
+	if err := o.blobs.Put(context.Background(), key, msg.Body); err != nil {
+		return fmt.Errorf("failed to store body: %w", err)
+	}
+	digest := sha256.Sum256(msg.Body)
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[ClaimCheckHeader] = key
+	headers[ClaimDigestHeader] = digest[:]
+	msg.Headers = headers
+	msg.Body = nil
+	return nil
+}
+
+// redeemClaim replaces the reference with the stored body, with WithVerification the body
+// must match the signed digest
+func (o *options) redeemClaim(d *amqp.Delivery) error {
+	key := claimKey(d.Headers)
+	if key == "" {
+		return nil
+	}
+	if o.blobs == nil {
+		return errors.New("message body is in a blob store but no store is configured")
+	}
+	body, err := o.blobs.Get(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch body %s: %w", key, err)
+	}
+	digest, _ := d.Headers[ClaimDigestHeader].([]byte)
+	if o.verifier != nil {
+		actual := sha256.Sum256(body)
+		if !bytes.Equal(digest, actual[:]) {
+			return fmt.Errorf("%w: body %s does not match its digest", ErrInvalidSignature, key)
+		}
+	}
+	d.Body = body
+	delete(d.Headers, ClaimCheckHeader)
+	delete(d.Headers, ClaimDigestHeader)
+	return nil
+}
+
+// releaseClaim deletes the blob once the message is settled, failures are only logged
+func (o *options) releaseClaim(key string, keyvals ...interface{}) {
+	if key == "" || o.blobs == nil {
+		return
+	}
+	if err := o.blobs.Delete(context.Background(), key); err != nil {
+		o.logger.Warn("Failed to delete message body", append(keyvals, FieldError, err)...)
+	}
+}
+
+func claimKey(headers amqp.Table) string {
+	key, _ := headers[ClaimCheckHeader].(string)
+	return key
+}
@@ -0,0 +1,139 @@
+package message
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestClaimCheckRoundTrip(t *testing.T) {
+	store, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, _ := ed25519.GenerateKey(nil)
+	sender := newOptions([]Option{WithClaimCheck(store, 1024), WithSigning(NewEd25519Signer(private))})
+	receiver := newOptions([]Option{WithClaimCheck(store, 1024), WithVerification(NewEd25519Verifier(public))})
+
+	body := bytes.Repeat([]byte("report"), 1000)
+	reference, err := sender.encodePublishing(&amqp.Publishing{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := claimKey(reference.Headers)
+	if key == "" || len(reference.Body) != 0 {
+		t.Fatalf("expected a reference message, got %d bytes", len(reference.Body))
+	}
+
+	d := deliveryOf(reference)
+	if err := receiver.decodeDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Body, body) {
+		t.Error("unexpected body")
+	}
+
+	receiver.releaseClaim(key)
+	if _, err := store.Get(context.Background(), key); !os.IsNotExist(err) {
+		t.Errorf("expected blob to be deleted, got %v", err)
+	}
+
+	small, _ := sender.encodePublishing(&amqp.Publishing{Body: []byte("small")})
+	if claimKey(small.Headers) != "" {
+		t.Error("small body should be sent inline")
+	}
+}
+
+func TestClaimCheckSignedKey(t *testing.T) {
+	store, _ := NewFileBlobStore(t.TempDir())
+	key := []byte("secret")
+	sender := newOptions([]Option{WithClaimCheck(store, 0), WithSigning(NewHMACSigner(key))})
+	receiver := newOptions([]Option{WithClaimCheck(store, 0), WithVerification(NewHMACVerifier(key))})
+
+	first, _ := sender.encodePublishing(&amqp.Publishing{Body: []byte("first")})
+	second, _ := sender.encodePublishing(&amqp.Publishing{Body: []byte("second")})
+	d := deliveryOf(first)
+	d.Headers[ClaimCheckHeader] = claimKey(second.Headers)
+	if err := receiver.decodeDelivery(d); err == nil {
+		t.Error("expected swapped claim check to fail verification")
+	}
+	if err := newOptions(nil).decodeDelivery(deliveryOf(second)); err == nil {
+		t.Error("expected error without blob store")
+	}
+	if err := store.Put(context.Background(), "../escape", nil); err == nil {
+		t.Error("expected invalid key to fail")
+	}
+}
+
+func TestClaimCheckTamperedBlob(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileBlobStore(dir)
+	key := []byte("secret")
+	sender := newOptions([]Option{WithClaimCheck(store, 0), WithSigning(NewHMACSigner(key))})
+	metrics := newCountingMetrics()
+	receiver := newOptions([]Option{WithClaimCheck(store, 0), WithVerification(NewHMACVerifier(key)),
+		WithMetrics(metrics)})
+
+	reference, err := sender.encodePublishing(&amqp.Publishing{Body: []byte("pay 10")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, claimKey(reference.Headers)), []byte("pay 1000"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.decodeDelivery(deliveryOf(reference)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+	if metrics.counters[MetricSignatureRejected] != 1 {
+		t.Errorf("expected the rejection to be counted, got %v", metrics.counters)
+	}
+}
+
+func TestClaimCheckReleasedOnReject(t *testing.T) {
+	store, _ := NewFileBlobStore(t.TempDir())
+	ack := &recordingAcknowledger{}
+	for _, c := range []struct {
+		opts []Option
+		kept bool
+	}{
+		{nil, true},
+		{[]Option{WithClaimReleaseOnReject()}, false},
+		{[]Option{WithClaimReleaseOnReject(), WithDeadLetterExchange("quarantine", "")}, true},
+	} {
+		store.Put(context.Background(), "blob", []byte("body"))
+		rnqm := newTestReceiver(append(c.opts, WithClaimCheck(store, 0))...)
+		rnqm.newDelivery(&amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, "blob", 0, false).Reject()
+		_, err := store.Get(context.Background(), "blob")
+		if kept := err == nil; kept != c.kept {
+			t.Errorf("blob kept %v, expected %v", kept, c.kept)
+		}
+	}
+}
+
+func TestFileBlobStoreExpire(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileBlobStore(dir)
+	ctx := context.Background()
+	store.Put(ctx, "old", []byte("old"))
+	store.Put(ctx, "new", []byte("new"))
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "old"), past, past)
+
+	deleted, err := store.Expire(ctx, time.Hour)
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 expired blob, got %d %v", deleted, err)
+	}
+	if _, err := store.Get(ctx, "old"); !os.IsNotExist(err) {
+		t.Errorf("expected old blob to be deleted, got %v", err)
+	}
+	if _, err := store.Get(ctx, "new"); err != nil {
+		t.Errorf("expected new blob to be kept, got %v", err)
+	}
+}
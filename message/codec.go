@@ -0,0 +1,57 @@
+package message
+
+import (
+	"errors"
+
+	"github.com/streadway/amqp"
+)
+
+// encodePublishing returns msg as it is sent on the wire, msg itself is not modified
+// The body is compressed first since encrypted bodies do not compress, the blob store
+// only sees encrypted bodies and the signature covers the final body, or the claim check and
+// the digest of the stored body
+func (o *options) encodePublishing(msg *amqp.Publishing) (*amqp.Publishing, error) {
+	encoded := *msg
+	if err := o.compress(&encoded); err != nil {
+		return nil, err
+	}
+	if err := o.encrypt(&encoded); err != nil {
+		return nil, err
+	}
+	if err := o.checkClaim(&encoded); err != nil {
+		return nil, err
+	}
+	if err := o.sign(&encoded); err != nil {
+		return nil, err
+	}
+	return &encoded, nil
+}
+
+// decodeDelivery reverses encodePublishing before the handler sees the delivery
+// An error means the delivery cannot be handled and is rejected without requeue
+// keyvals identify the queue or exchange in metrics
+func (o *options) decodeDelivery(d *amqp.Delivery, keyvals ...interface{}) error {
+	err := o.verify(d)
+	if err == nil {
+		err = o.redeemClaim(d)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidSignature) {
+			o.metrics.Add(MetricSignatureRejected, 1, keyvals...)
+		}
+		return err
+	}
+	if err := o.decrypt(d); err != nil {
+		return err
+	}
+	return o.decompress(d)
+}
+
+// rejectDelivery sends a delivery that cannot be decoded to the dead-letter path
+func rejectDelivery(logger Logger, d *amqp.Delivery, reason error, keyvals ...interface{}) {
+	keyvals = append(keyvals, FieldDeliveryTag, d.DeliveryTag, FieldMessageID, d.MessageId)
+	logger.Error("Rejecting message", append(keyvals, FieldError, reason)...)
+	if err := d.Reject(false /*requeue*/); err != nil {
+		logger.Error("Cannot reject the message", append(keyvals, FieldError, err)...)
+	}
+}
@@ -0,0 +1,190 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/streadway/amqp"
+)
+
+// Content encodings supported by WithCompression, receivers decompress all of them
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// encodingIdentity is the explicit no encoding value
+const encodingIdentity = "identity"
+
+// DefaultMaxDecompressedSize is the largest body receivers decompress by default, 128 MiB is RabbitMQ's
+// default maximum message size, 1024 frames of the default 128 KiB frame max
+const DefaultMaxDecompressedSize = 128 << 20
+
+// ErrBodyTooLarge is returned for a compressed body that decompresses to more than the maximum size,
+// the delivery is rejected
+var ErrBodyTooLarge = errors.New("decompressed body is too large")
+
+type compressor interface {
+	compress(body []byte) ([]byte, error)
+	// decompress fails with ErrBodyTooLarge once the body exceeds limit bytes
+	decompress(body []byte, limit int) ([]byte, error)
+}
+
+var compressors = map[string]compressor{
+	EncodingGzip:   gzipCompressor{},
+	EncodingZstd:   &zstdCompressor{},
+	EncodingSnappy: snappyCompressor{},
+}
+
+// WithCompression compresses bodies of at least threshold bytes with encoding on send
+// and sets ContentEncoding, messages that already have a ContentEncoding are sent as is
+func WithCompression(encoding string, threshold int) Option {
+	return func(o *options) {
+		if _, ok := compressors[encoding]; !ok {
+			o.setErr(fmt.Errorf("unsupported compression %q", encoding))
+			return
+		}
+		o.compression = encoding
+		o.compressionThreshold = threshold
+	}
+}
+
+// WithMaxDecompressedSize changes the largest body receivers decompress from DefaultMaxDecompressedSize,
+// larger ones are rejected with ErrBodyTooLarge instead of exhausting memory
+func WithMaxDecompressedSize(size int) Option {
+	return func(o *options) {
+		if size < 1 {
+			o.setErr(fmt.Errorf("invalid maximum decompressed size %d", size))
+			return
+		}
+		o.maxDecompressedSize = size
+	}
+}
+
+// compress applies the configured compression to msg
+func (o *options) compress(msg *amqp.Publishing) error {
+	if o.compression == "" || msg.ContentEncoding != "" || len(msg.Body) < o.compressionThreshold {
+		return nil
+	}
+	body, err := compressors[o.compression].compress(msg.Body)
+	if err != nil {
+		return err
+	}
+	msg.Body = body
+	msg.ContentEncoding = o.compression
+	return nil
+}
+
+// decompress restores the body based on ContentEncoding and clears it
+// Unknown encodings and bodies larger than the maximum return an error so the delivery is rejected
+func (o *options) decompress(d *amqp.Delivery) error {
+	if d.ContentEncoding == "" || d.ContentEncoding == encodingIdentity {
+		return nil
+	}
+	c, ok := compressors[d.ContentEncoding]
+	if !ok {
+		return fmt.Errorf("unsupported content encoding %q", d.ContentEncoding)
+	}
+	limit := o.maxDecompressedSize
+	if limit == 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+	body, err := c.decompress(d.Body, limit)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s body: %w", d.ContentEncoding, err)
+	}
+	d.Body = body
+	d.ContentEncoding = ""
+	return nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) decompress(body []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+// readLimited reads r to the end, reading one byte past limit tells a body of exactly limit bytes from a larger one
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, limit)
+	}
+	return body, nil
+}
+
+// zstdCompressor shares one encoder, EncodeAll is safe for concurrent use
+// Bodies are decompressed by a stream decoder per message, DecodeAll cannot stop at a limit
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	err     error
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		z.encoder, z.err = zstd.NewWriter(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) compress(body []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.encoder.EncodeAll(body, nil), nil
+}
+
+func (z *zstdCompressor) decompress(body []byte, limit int) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, limit)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) compress(body []byte) ([]byte, error) {
+	return snappy.Encode(nil, body), nil
+}
+
+func (snappyCompressor) decompress(body []byte, limit int) ([]byte, error) {
+	// the decoded length is in the header, check it before allocating
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBodyTooLarge, n)
+	}
+	return snappy.Decode(nil, body)
+}
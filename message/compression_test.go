@@ -0,0 +1,90 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"event":"created","id":12345}`), 100)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		o := newOptions([]Option{WithCompression(encoding, 1024)})
+		msg := &amqp.Publishing{Body: body}
+		encoded, err := o.encodePublishing(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded.ContentEncoding != encoding || len(encoded.Body) >= len(body) {
+			t.Errorf("%s: expected compressed body, got %d bytes with encoding %q",
+				encoding, len(encoded.Body), encoded.ContentEncoding)
+		}
+		if msg.ContentEncoding != "" || !bytes.Equal(msg.Body, body) {
+			t.Errorf("%s: original message was modified", encoding)
+		}
+
+		d := &amqp.Delivery{ContentEncoding: encoded.ContentEncoding, Body: encoded.Body}
+		if err := o.decodeDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d.Body, body) || d.ContentEncoding != "" {
+			t.Errorf("%s: unexpected decoded body", encoding)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	o := newOptions([]Option{WithCompression(EncodingGzip, 1024)})
+	encoded, err := o.encodePublishing(&amqp.Publishing{Body: []byte("small")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded.ContentEncoding != "" || string(encoded.Body) != "small" {
+		t.Errorf("expected small body to be sent uncompressed, got %q", encoded.ContentEncoding)
+	}
+}
+
+func TestUnknownContentEncoding(t *testing.T) {
+	o := newOptions(nil)
+	if err := o.decodeDelivery(&amqp.Delivery{ContentEncoding: "br", Body: []byte("x")}); err == nil {
+		t.Error("expected error for unknown content encoding")
+	}
+	if err := o.decodeDelivery(&amqp.Delivery{ContentEncoding: EncodingGzip, Body: []byte("not gzip")}); err == nil {
+		t.Error("expected error for corrupt body")
+	}
+	if o := newOptions([]Option{WithCompression("lz4", 0)}); o.err == nil {
+		t.Error("expected error for unsupported compression")
+	}
+}
+
+func TestMaxDecompressedSize(t *testing.T) {
+	body := bytes.Repeat([]byte{0}, 4096)
+	for _, encoding := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		encoded, err := newOptions([]Option{WithCompression(encoding, 0)}).encodePublishing(&amqp.Publishing{Body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			size     int
+			tooLarge bool
+		}{
+			{len(body), false},
+			{len(body) - 1, true},
+		} {
+			o := newOptions([]Option{WithMaxDecompressedSize(c.size)})
+			d := &amqp.Delivery{ContentEncoding: encoded.ContentEncoding, Body: encoded.Body}
+			err := o.decodeDelivery(d)
+			if tooLarge := errors.Is(err, ErrBodyTooLarge); tooLarge != c.tooLarge {
+				t.Errorf("%s: limit %d: expected too large %v, got %v", encoding, c.size, c.tooLarge, err)
+			}
+			if err == nil && !bytes.Equal(d.Body, body) {
+				t.Errorf("%s: body changed", encoding)
+			}
+		}
+	}
+	if o := newOptions([]Option{WithMaxDecompressedSize(0)}); o.err == nil {
+		t.Error("expected error for a zero maximum size")
+	}
+}
@@ -0,0 +1,94 @@
+package message
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// same defaults as amqp.Dial
+	defaultHeartbeat = 10 * time.Second
+	defaultLocale    = "en_US"
+
+	connectionProduct = "https://github.com/qulia/go-message"
+)
+
+// ExternalAuth is the EXTERNAL SASL mechanism, the broker takes the user from the TLS client certificate
+// The broker needs the rabbitmq_auth_mechanism_ssl plugin
+type ExternalAuth struct{}
+
+// Mechanism returns "EXTERNAL"
+func (ExternalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response is empty, the identity comes from the certificate
+func (ExternalAuth) Response() string {
+	return ""
+}
+
+// WithDialConfig connects with amqp.DialConfig instead of amqp.Dial, for TLS and client certificates,
+// SASL mechanisms such as ExternalAuth, heartbeat, frame size, locale and client properties
+// A zero Heartbeat or empty Locale uses the amqp.Dial defaults, use an amqps:// address for TLS
+func WithDialConfig(config amqp.Config) Option {
+	return func(o *options) {
+		o.dialConfig = &config
+	}
+}
+
+// WithConnectionName sets the connection name shown by the broker's management UI
+func WithConnectionName(name string) Option {
+	return func(o *options) {
+		o.connectionName = name
+	}
+}
+
+// dial connects to the server, with WithFailover to the first reachable node
+func (o *options) dial(serverAddress string) (*amqp.Connection, error) {
+	if o.failover == nil {
+		return o.dialAddress(serverAddress)
+	}
+	var err error
+	for _, address := range o.failover.order(serverAddress) {
+		var conn *amqp.Connection
+		conn, err = o.dialAddress(address)
+		o.failover.result(address, err)
+		if err == nil {
+			o.logger.Info("Connected to RabbitMQ", FieldServer, nodeName(address))
+			return conn, nil
+		}
+		o.logger.Warn("Failed to connect to RabbitMQ node", FieldServer, nodeName(address), FieldError, err)
+	}
+	return nil, err
+}
+
+// dialAddress connects to one server with the connection options
+func (o *options) dialAddress(serverAddress string) (*amqp.Connection, error) {
+	config := amqp.Config{}
+	if o.dialConfig != nil {
+		config = *o.dialConfig
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = defaultHeartbeat
+	}
+	if config.Locale == "" {
+		config.Locale = defaultLocale
+	}
+	// amqp.DialConfig writes to the TLS config and the properties, every dial gets its own copy
+	if config.TLSClientConfig != nil {
+		config.TLSClientConfig = config.TLSClientConfig.Clone()
+	}
+	if len(config.Properties) > 0 || o.connectionName != "" {
+		properties := amqp.Table{"product": connectionProduct}
+		for k, v := range config.Properties {
+			properties[k] = v
+		}
+		if o.connectionName != "" {
+			properties["connection_name"] = o.connectionName
+		}
+		config.Properties = properties
+	}
+	conn, err := amqp.DialConfig(serverAddress, config)
+	return conn, dialError(err)
+}
@@ -0,0 +1,156 @@
+package message
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// newTestCert returns a certificate signed by parent, or self-signed without a parent
+func newTestCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// connectionStartFrame is a connection.start offering the EXTERNAL mechanism
+func connectionStartFrame() []byte {
+	var payload bytes.Buffer
+	binary.Write(&payload, binary.BigEndian, uint16(10)) // class connection
+	binary.Write(&payload, binary.BigEndian, uint16(10)) // method start
+	payload.Write([]byte{0, 9})                          // version
+	binary.Write(&payload, binary.BigEndian, uint32(0))  // server properties
+	for _, s := range []string{"EXTERNAL", "en_US"} {
+		binary.Write(&payload, binary.BigEndian, uint32(len(s)))
+		payload.WriteString(s)
+	}
+	var frame bytes.Buffer
+	frame.Write([]byte{1, 0, 0}) // method frame on channel 0
+	binary.Write(&frame, binary.BigEndian, uint32(payload.Len()))
+	frame.Write(payload.Bytes())
+	frame.WriteByte(0xce)
+	return frame.Bytes()
+}
+
+func TestDialConfigMutualTLS(t *testing.T) {
+	ca, caKey, _ := newTestCert(t, "test ca", true, nil, nil)
+	_, _, serverCert := newTestCert(t, "server", false, ca, caKey)
+	_, _, clientCert := newTestCert(t, "client", false, ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type handshake struct {
+		peer    string
+		startOk []byte
+		err     error
+	}
+	result := make(chan handshake, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- handshake{err: err}
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			result <- handshake{err: err}
+			return
+		}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			result <- handshake{err: err}
+			return
+		}
+		conn.Write(connectionStartFrame())
+		frameHeader := make([]byte, 7)
+		if _, err := io.ReadFull(conn, frameHeader); err != nil {
+			result <- handshake{err: err}
+			return
+		}
+		startOk := make([]byte, binary.BigEndian.Uint32(frameHeader[3:]))
+		_, err = io.ReadFull(conn, startOk)
+		result <- handshake{
+			peer:    tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName,
+			startOk: startOk,
+			err:     err,
+		}
+	}()
+
+	o := newOptions([]Option{
+		WithDialConfig(amqp.Config{
+			SASL: []amqp.Authentication{ExternalAuth{}},
+			TLSClientConfig: &tls.Config{
+				RootCAs:      pool,
+				Certificates: []tls.Certificate{clientCert},
+			},
+		}),
+		WithConnectionName("orders"),
+	})
+	// the fake broker stops after connection.start-ok so the dial itself fails
+	go o.dial("amqps://" + listener.Addr().String() + "/")
+
+	select {
+	case h := <-result:
+		if h.err != nil {
+			t.Fatal(h.err)
+		}
+		if h.peer != "client" {
+			t.Fatalf("unexpected client certificate %s", h.peer)
+		}
+		for _, expected := range []string{"EXTERNAL", "connection_name", "orders"} {
+			if !bytes.Contains(h.startOk, []byte(expected)) {
+				t.Fatalf("connection.start-ok does not contain %s", expected)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection")
+	}
+}
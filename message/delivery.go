@@ -0,0 +1,174 @@
+package message
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrAlreadySettled is returned when a delivery is acked, nacked or rejected a second time
+var ErrAlreadySettled = errors.New("delivery is already settled")
+
+// Delivery is a received message the handler settles with Ack, Nack or Reject
+// A delivery the handler did not settle or Defer is acked when the handler returns nil and
+// nacked with requeue when it returns an error
+// Use the methods of Delivery instead of the embedded amqp.Delivery ones, they release the claim
+// check, track the stream offset and protect against settling twice
+type Delivery struct {
+	*amqp.Delivery
+	rnqm     *ReceiveNamedQueueManager
+	claim    string
+	offset   int64
+	tracked  bool
+	mu       sync.Mutex
+	settled  bool
+	deferred bool
+	leak     *time.Timer
+}
+
+// WithUnsettledTimeout flags deliveries that are not settled within timeout after they reach the
+// handler, they are logged and counted as MetricUnsettled
+func WithUnsettledTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout <= 0 {
+			o.setErr(errors.New("unsettled timeout must be positive"))
+			return
+		}
+		o.unsettledTimeout = timeout
+	}
+}
+
+func (rnqm *ReceiveNamedQueueManager) newDelivery(msg *amqp.Delivery, claim string, offset int64, tracked bool) *Delivery {
+	d := &Delivery{Delivery: msg, rnqm: rnqm, claim: claim, offset: offset, tracked: tracked}
+	atomic.AddInt64(&rnqm.unsettled, 1)
+	if timeout := rnqm.namedQueueManager.options.unsettledTimeout; timeout > 0 && !rnqm.autoAck {
+		d.leak = time.AfterFunc(timeout, d.leaked)
+	}
+	return d
+}
+
+// Ack acknowledges the delivery, the broker removes the message
+// With WithAckBatch the ack is queued and sent with the next batch
+func (d *Delivery) Ack() error {
+	if acks := d.rnqm.batcher(d.Delivery); acks != nil {
+		return d.settle("", false, func() error {
+			acks.add(d.DeliveryTag, d.releaseClaim)
+			return nil
+		})
+	}
+	return d.settle("Cannot ACK the message", true, func() error {
+		return d.Delivery.Ack(false)
+	})
+}
+
+// Nack negatively acknowledges the delivery, with requeue the broker delivers the message again,
+// otherwise it is dropped or dead-lettered
+func (d *Delivery) Nack(requeue bool) error {
+	return d.settle("Cannot NACK the message", !requeue && d.dropped(), func() error {
+		defer d.rnqm.batcher(d.Delivery).settled(d.DeliveryTag)
+		return d.Delivery.Nack(false, requeue)
+	})
+}
+
+// Reject rejects the delivery without requeue, the message is dropped or dead-lettered
+func (d *Delivery) Reject() error {
+	return d.settle("Cannot reject the message", d.dropped(), func() error {
+		defer d.rnqm.batcher(d.Delivery).settled(d.DeliveryTag)
+		return d.Delivery.Reject(false)
+	})
+}
+
+// Defer tells the receiver the delivery is settled later, possibly from another goroutine,
+// so it is not settled when the handler returns
+func (d *Delivery) Defer() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deferred = true
+}
+
+// settle runs op once, in auto ack mode the broker settled the delivery already and op is skipped
+// release deletes the claimed body once the message has left the queue for good
+func (d *Delivery) settle(failMsg string, release bool, op func() error) error {
+	o := d.rnqm.namedQueueManager.options
+	queueName := d.rnqm.namedQueueManager.queue.Name
+	d.mu.Lock()
+	if d.settled {
+		d.mu.Unlock()
+		o.logger.Warn("Delivery settled twice", FieldQueue, queueName,
+			FieldDeliveryTag, d.DeliveryTag, FieldMessageID, d.MessageId)
+		return ErrAlreadySettled
+	}
+	d.settled = true
+	d.mu.Unlock()
+	if d.leak != nil {
+		d.leak.Stop()
+	}
+	atomic.AddInt64(&d.rnqm.unsettled, -1)
+	if d.tracked {
+		defer d.rnqm.stream.settled(d.offset)
+	}
+
+	if d.rnqm.autoAck {
+		d.releaseClaim()
+		return nil
+	}
+	err := op()
+	if err != nil {
+		o.logger.Error(failMsg, FieldQueue, queueName,
+			FieldDeliveryTag, d.DeliveryTag, FieldMessageID, d.MessageId, FieldError, err)
+		return brokerError(err, nil)
+	}
+	if release {
+		d.releaseClaim()
+	}
+	return nil
+}
+
+// dropped reports whether a message that is not requeued is known to be discarded, the queue may
+// dead-letter it through WithPassive, its topology arguments or a policy, so this needs WithClaimReleaseOnReject
+func (d *Delivery) dropped() bool {
+	o := d.rnqm.namedQueueManager.options
+	return o.releaseRejected && o.deadLetterExchange == ""
+}
+
+func (d *Delivery) releaseClaim() {
+	d.rnqm.namedQueueManager.options.releaseClaim(d.claim,
+		FieldQueue, d.rnqm.namedQueueManager.queue.Name, FieldMessageID, d.MessageId)
+}
+
+// settleOnReturn settles the delivery by the handler's result unless the handler settled or deferred it
+func (d *Delivery) settleOnReturn(err error) {
+	d.mu.Lock()
+	done := d.settled || d.deferred
+	d.mu.Unlock()
+	if done {
+		return
+	}
+	if err == nil || d.rnqm.autoAck {
+		d.Ack()
+	} else {
+		d.Nack(true)
+	}
+}
+
+func (d *Delivery) leaked() {
+	d.mu.Lock()
+	settled := d.settled
+	d.mu.Unlock()
+	if settled {
+		return
+	}
+	o := d.rnqm.namedQueueManager.options
+	queueName := d.rnqm.namedQueueManager.queue.Name
+	o.logger.Warn("Delivery is not settled", FieldQueue, queueName,
+		FieldDeliveryTag, d.DeliveryTag, FieldMessageID, d.MessageId)
+	o.metrics.Add(MetricUnsettled, 1, FieldQueue, queueName)
+}
+
+// Unsettled returns the number of deliveries handed to the handler and not settled yet
+func (rnqm *ReceiveNamedQueueManager) Unsettled() int {
+	return int(atomic.LoadInt64(&rnqm.unsettled))
+}
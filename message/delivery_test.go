@@ -0,0 +1,113 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// recordingAcknowledger records the settlements instead of sending them to the broker
+type recordingAcknowledger struct {
+	mu      sync.Mutex
+	settled []string
+}
+
+func (a *recordingAcknowledger) record(format string, args ...interface{}) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.settled = append(a.settled, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.record("ack %d %v", tag, multiple)
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	return a.record("nack %d %v %v", tag, multiple, requeue)
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.record("reject %d %v", tag, requeue)
+}
+
+func (a *recordingAcknowledger) String() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return fmt.Sprint(a.settled)
+}
+
+func newTestReceiver(opts ...Option) *ReceiveNamedQueueManager {
+	return &ReceiveNamedQueueManager{namedQueueManager: &NamedQueueManager{
+		queue:   &amqp.Queue{Name: "test"},
+		options: newOptions(opts),
+	}}
+}
+
+func TestDeliverySettle(t *testing.T) {
+	rnqm := newTestReceiver()
+	ack := &recordingAcknowledger{}
+	handle := func(tag uint64, onReceive func(*Delivery) error) *Delivery {
+		d := rnqm.newDelivery(&amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}, "", 0, false)
+		d.settleOnReturn(onReceive(d))
+		return d
+	}
+
+	handle(1, func(d *Delivery) error { return nil })
+	handle(2, func(d *Delivery) error { return errors.New("failed") })
+	handle(3, func(d *Delivery) error { return d.Reject() })
+	d := handle(4, func(d *Delivery) error {
+		if err := d.Nack(false); err != nil {
+			return err
+		}
+		if err := d.Ack(); !errors.Is(err, ErrAlreadySettled) {
+			t.Errorf("expected ErrAlreadySettled, got %v", err)
+		}
+		return nil
+	})
+	if err := d.Reject(); !errors.Is(err, ErrAlreadySettled) {
+		t.Fatalf("expected ErrAlreadySettled, got %v", err)
+	}
+
+	// a deferred delivery is settled from another goroutine after the handler returned
+	deferred := make(chan *Delivery, 1)
+	handle(5, func(d *Delivery) error {
+		d.Defer()
+		deferred <- d
+		return nil
+	})
+	if rnqm.Unsettled() != 1 {
+		t.Fatalf("expected one unsettled delivery, got %d", rnqm.Unsettled())
+	}
+	go (<-deferred).Ack()
+	for rnqm.Unsettled() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	expected := "[ack 1 false nack 2 false true reject 3 false nack 4 false false ack 5 false]"
+	if ack.String() != expected {
+		t.Fatalf("unexpected settlements %s", ack)
+	}
+}
+
+func TestDeliveryLeakDetector(t *testing.T) {
+	metrics := newCountingMetrics()
+	rnqm := newTestReceiver(WithMetrics(metrics), WithUnsettledTimeout(10*time.Millisecond))
+	ack := &recordingAcknowledger{}
+
+	settled := rnqm.newDelivery(&amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, "", 0, false)
+	settled.Ack()
+	leaked := rnqm.newDelivery(&amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}, "", 0, false)
+	leaked.Defer()
+
+	time.Sleep(50 * time.Millisecond)
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.counters[MetricUnsettled] != 1 {
+		t.Fatalf("expected one unsettled delivery, got %d", metrics.counters[MetricUnsettled])
+	}
+}
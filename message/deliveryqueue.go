@@ -0,0 +1,74 @@
+package message
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// deliveryQueue buffers deliveries for the workers, the highest priority is popped first
+// and deliveries of the same priority keep their order
+type deliveryQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  deliveryHeap
+	closed bool
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	q := new(deliveryQueue)
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *deliveryQueue) push(d amqp.Delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.items, d)
+	q.cond.Signal()
+}
+
+// pop blocks until a delivery is available, returns false once the queue is closed
+func (q *deliveryQueue) pop() (amqp.Delivery, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return amqp.Delivery{}, false
+	}
+	return heap.Pop(&q.items).(amqp.Delivery), true
+}
+
+// close wakes up the workers and hands the buffered deliveries to requeue
+func (q *deliveryQueue) close(requeue func(*amqp.Delivery)) {
+	q.mu.Lock()
+	items := q.items
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	for i := range items {
+		requeue(&items[i])
+	}
+}
+
+type deliveryHeap []amqp.Delivery
+
+func (h deliveryHeap) Len() int { return len(h) }
+func (h deliveryHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].DeliveryTag < h[j].DeliveryTag
+}
+func (h deliveryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deliveryHeap) Push(x interface{}) { *h = append(*h, x.(amqp.Delivery)) }
+func (h *deliveryHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
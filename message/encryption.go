@@ -0,0 +1,217 @@
+package message
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers set on encrypted messages
+const (
+	// EncryptionKeyIDHeader holds the ID of the key that wrapped the data key
+	EncryptionKeyIDHeader = "x-encryption-key-id"
+	// EncryptionDataKeyHeader holds the wrapped per message data key
+	EncryptionDataKeyHeader = "x-encryption-data-key"
+)
+
+// encryptionKeySize is the AES-256 key size
+const encryptionKeySize = 32
+
+// KeyProvider supplies the AES-256 keys used to wrap the per message data keys
+// Keys can be rotated by changing the current key, older keys must stay available
+// as long as messages encrypted with them may still be queued
+type KeyProvider interface {
+	// CurrentKey returns the key used for new messages and its ID
+	CurrentKey() (keyID string, key []byte, err error)
+	// Key returns the key with the given ID
+	Key(keyID string) ([]byte, error)
+}
+
+// KeyRing is an in memory KeyProvider, safe for concurrent use
+type KeyRing struct {
+	mu        sync.RWMutex
+	currentID string
+	keys      map[string][]byte
+}
+
+// NewKeyRing creates a key ring that encrypts with the key currentID
+func NewKeyRing(currentID string, key []byte) (*KeyRing, error) {
+	kr := &KeyRing{keys: map[string][]byte{}}
+	if err := kr.Rotate(currentID, key); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Add makes the key available for decryption without using it for new messages
+func (kr *KeyRing) Add(keyID string, key []byte) error {
+	if len(key) != encryptionKeySize {
+		return fmt.Errorf("key %q must be %d bytes", keyID, encryptionKeySize)
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[keyID] = key
+	return nil
+}
+
+// Rotate adds the key and uses it for new messages, previous keys stay available for decryption
+func (kr *KeyRing) Rotate(keyID string, key []byte) error {
+	if err := kr.Add(keyID, key); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.currentID = keyID
+	return nil
+}
+
+// Remove drops a key that is no longer needed, the current key cannot be removed
+func (kr *KeyRing) Remove(keyID string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if keyID == kr.currentID {
+		return fmt.Errorf("key %q is the current key", keyID)
+	}
+	delete(kr.keys, keyID)
+	return nil
+}
+
+// CurrentKey implements KeyProvider
+func (kr *KeyRing) CurrentKey() (string, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.currentID, kr.keys[kr.currentID], nil
+}
+
+// Key implements KeyProvider
+func (kr *KeyRing) Key(keyID string) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+	return key, nil
+}
+
+// WithEncryption encrypts bodies on send and decrypts them on receive
+// Each body is encrypted with a random AES-256-GCM data key which is wrapped with the provider's
+// current key, the key ID and wrapped data key are sent in headers
+// Receivers reject encrypted messages they have no key for
+func WithEncryption(keys KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// encrypt applies envelope encryption to msg, headers are copied before they are changed
+func (o *options) encrypt(msg *amqp.Publishing) error {
+	if o.keys == nil {
+		return nil
+	}
+	keyID, key, err := o.keys.CurrentKey()
+	if err != nil {
+		return err
+	}
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+	// the data key is bound to the key ID, the body to the content encoding
+	wrappedKey, err := seal(key, dataKey, []byte(keyID))
+	if err != nil {
+		return err
+	}
+	body, err := seal(dataKey, msg.Body, []byte(msg.ContentEncoding))
+	if err != nil {
+		return err
+	}
+
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[EncryptionKeyIDHeader] = keyID
+	headers[EncryptionDataKeyHeader] = wrappedKey
+	msg.Headers = headers
+	msg.Body = body
+	return nil
+}
+
+// decrypt reverses encrypt, messages without the encryption headers are left as is
+func (o *options) decrypt(d *amqp.Delivery) error {
+	rawID, ok := d.Headers[EncryptionKeyIDHeader]
+	if !ok {
+		return nil
+	}
+	if o.keys == nil {
+		return errors.New("message is encrypted but no key provider is configured")
+	}
+	keyID, ok := rawID.(string)
+	if !ok {
+		return fmt.Errorf("invalid %s header", EncryptionKeyIDHeader)
+	}
+	wrappedKey, ok := d.Headers[EncryptionDataKeyHeader].([]byte)
+	if !ok {
+		return fmt.Errorf("invalid %s header", EncryptionDataKeyHeader)
+	}
+	key, err := o.keys.Key(keyID)
+	if err != nil {
+		return err
+	}
+	dataKey, err := open(key, wrappedKey, []byte(keyID))
+	if err != nil {
+		return fmt.Errorf("failed to unwrap data key with key %q: %w", keyID, err)
+	}
+	body, err := open(dataKey, d.Body, []byte(d.ContentEncoding))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt body: %w", err)
+	}
+	d.Body = body
+	delete(d.Headers, EncryptionKeyIDHeader)
+	delete(d.Headers, EncryptionDataKeyHeader)
+	return nil
+}
+
+// seal encrypts with AES-GCM and prepends the random nonce
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open reverses seal
+func open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("key must be %d bytes", encryptionKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
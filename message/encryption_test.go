@@ -0,0 +1,86 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func deliveryOf(msg *amqp.Publishing) *amqp.Delivery {
+	return &amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentEncoding: msg.ContentEncoding,
+		Body:            msg.Body,
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	keys, err := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newOptions([]Option{WithEncryption(keys), WithCompression(EncodingGzip, 0)})
+
+	plaintext := []byte("social security number")
+	old, err := o.encodePublishing(&amqp.Publishing{Body: plaintext, Headers: amqp.Table{"tenant": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(old.Body, plaintext) || old.Headers[EncryptionKeyIDHeader] != "k1" {
+		t.Fatalf("unexpected encrypted message %v", old.Headers)
+	}
+
+	if err := keys.Rotate("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	current, err := o.encodePublishing(&amqp.Publishing{Body: plaintext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Headers[EncryptionKeyIDHeader] != "k2" {
+		t.Errorf("expected new key, got %v", current.Headers[EncryptionKeyIDHeader])
+	}
+
+	for _, msg := range []*amqp.Publishing{old, current} {
+		d := deliveryOf(msg)
+		if err := o.decodeDelivery(d); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d.Body, plaintext) {
+			t.Errorf("unexpected body %q", d.Body)
+		}
+		if _, ok := d.Headers[EncryptionDataKeyHeader]; ok {
+			t.Error("encryption headers were not removed")
+		}
+	}
+}
+
+func TestEncryptionRejects(t *testing.T) {
+	keys, _ := NewKeyRing("k1", bytes.Repeat([]byte{1}, 32))
+	o := newOptions([]Option{WithEncryption(keys)})
+	msg, err := o.encodePublishing(&amqp.Publishing{Body: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := deliveryOf(msg)
+	tampered.Body = append([]byte{}, msg.Body...)
+	tampered.Body[len(tampered.Body)-1] ^= 1
+	if err := o.decodeDelivery(tampered); err == nil {
+		t.Error("expected tampered body to fail")
+	}
+
+	if err := newOptions(nil).decodeDelivery(deliveryOf(msg)); err == nil {
+		t.Error("expected error without key provider")
+	}
+
+	otherKeys, _ := NewKeyRing("k9", bytes.Repeat([]byte{9}, 32))
+	if err := newOptions([]Option{WithEncryption(otherKeys)}).decodeDelivery(deliveryOf(msg)); err == nil {
+		t.Error("expected error for unknown key ID")
+	}
+
+	if _, err := NewKeyRing("short", []byte("too short")); err == nil {
+		t.Error("expected error for short key")
+	}
+}
@@ -0,0 +1,127 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrClosed is returned when the connection or channel was closed, by Close or by the broker
+	ErrClosed = errors.New("connection or channel is closed")
+	// ErrNotConnected is returned when the server cannot be reached
+	ErrNotConnected = errors.New("not connected to the broker")
+	// ErrNacked is returned by Send with publisher confirms when the broker could not take the message
+	ErrNacked = errors.New("broker nacked the message")
+	// ErrUnconfirmed is returned by Send with publisher confirms when the context is done before the
+	// confirm arrives, the message was published and may or may not have been taken by the broker
+	// so it is not retryable, resending it may deliver it twice
+	ErrUnconfirmed = errors.New("confirm not received")
+	// ErrPreconditionFailed matches a BrokerError for a queue or exchange that exists with other settings
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrNotFound matches a BrokerError for a queue or exchange that does not exist, see WithPassive
+	ErrNotFound = errors.New("not found")
+	// ErrAccessRefused matches a BrokerError for refused credentials or permissions
+	ErrAccessRefused = errors.New("access refused")
+	// ErrTimeout is returned when connecting or waiting timed out
+	ErrTimeout = errors.New("timed out")
+)
+
+// inequivalentArg finds the argument in the broker's precondition failure reason
+var inequivalentArg = regexp.MustCompile(`inequivalent arg '([^']+)'`)
+
+// BrokerError is an error the broker closed the channel or connection with
+// It matches ErrPreconditionFailed, ErrNotFound, ErrAccessRefused and ErrClosed with errors.Is
+// and unwraps to the *amqp.Error
+type BrokerError struct {
+	Code   int
+	Reason string
+	// Argument is the conflicting argument of a precondition failure, empty if the broker did not name it
+	Argument string
+	// Arguments are the arguments the queue or exchange was declared with
+	Arguments amqp.Table
+	Err       *amqp.Error
+}
+
+func (e *BrokerError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the *amqp.Error
+func (e *BrokerError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel errors of the reply code
+func (e *BrokerError) Is(target error) bool {
+	switch target {
+	case ErrPreconditionFailed:
+		return e.Code == amqp.PreconditionFailed
+	case ErrNotFound:
+		return e.Code == amqp.NotFound
+	case ErrAccessRefused:
+		return e.Code == amqp.AccessRefused
+	case ErrClosed:
+		return e.Err == amqp.ErrClosed || e.Code == amqp.ConnectionForced || e.Code == amqp.ChannelError
+	}
+	return false
+}
+
+// Retryable reports whether err is temporary so the same call can succeed later or after reconnecting
+// Refused access, missing entities, conflicting settings and unroutable messages need a fix instead
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var brokerErr *BrokerError
+	if errors.As(err, &brokerErr) {
+		switch brokerErr.Code {
+		case amqp.ContentTooLarge, amqp.InvalidPath, amqp.AccessRefused, amqp.NotFound, amqp.PreconditionFailed,
+			amqp.FrameError, amqp.SyntaxError, amqp.CommandInvalid, amqp.NotAllowed, amqp.NotImplemented:
+			return false
+		}
+		return true
+	}
+	for _, temporary := range []error{ErrClosed, ErrNotConnected, ErrTimeout, ErrNacked, ErrBlocked, ErrRateLimited, ErrSpoolFull} {
+		if errors.Is(err, temporary) {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerError turns an *amqp.Error into a BrokerError, args are the declared arguments if any
+func brokerError(err error, args amqp.Table) error {
+	var amqpErr *amqp.Error
+	if err == nil || !errors.As(err, &amqpErr) {
+		return err
+	}
+	var brokerErr *BrokerError
+	if errors.As(err, &brokerErr) {
+		return err
+	}
+	brokerErr = &BrokerError{Code: amqpErr.Code, Reason: amqpErr.Reason, Arguments: args, Err: amqpErr}
+	if m := inequivalentArg.FindStringSubmatch(amqpErr.Reason); m != nil {
+		brokerErr.Argument = m[1]
+	}
+	return brokerErr
+}
+
+// dialError wraps a failed connect in ErrNotConnected, and ErrTimeout if it timed out
+func dialError(err error) error {
+	var amqpErr *amqp.Error
+	if err == nil || errors.As(err, &amqpErr) {
+		return brokerError(err, nil)
+	}
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w: %w", ErrNotConnected, ErrTimeout, err)
+	}
+	return fmt.Errorf("%w: %w", ErrNotConnected, err)
+}
@@ -0,0 +1,80 @@
+package message
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestBrokerError(t *testing.T) {
+	args := amqp.Table{"x-max-length": int64(20)}
+	err := brokerError(&amqp.Error{
+		Code:   amqp.PreconditionFailed,
+		Reason: "PRECONDITION_FAILED - inequivalent arg 'x-max-length' for queue 'q' in vhost '/': received '20' but current is '10'",
+	}, args)
+
+	if !errors.Is(err, ErrPreconditionFailed) || errors.Is(err, ErrAccessRefused) || errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected matches for %v", err)
+	}
+	var brokerErr *BrokerError
+	if !errors.As(err, &brokerErr) || brokerErr.Argument != "x-max-length" || brokerErr.Arguments["x-max-length"] != int64(20) {
+		t.Fatalf("unexpected broker error %+v", brokerErr)
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		t.Fatal("expected the broker error to unwrap to *amqp.Error")
+	}
+	if Retryable(err) {
+		t.Fatal("precondition failures are not retryable")
+	}
+
+	closed := brokerError(amqp.ErrClosed, nil)
+	if !errors.Is(closed, ErrClosed) || !errors.Is(closed, amqp.ErrClosed) || !Retryable(closed) {
+		t.Fatalf("unexpected classification of %v", closed)
+	}
+	if missing := brokerError(&amqp.Error{Code: amqp.NotFound}, nil); !errors.Is(missing, ErrNotFound) || Retryable(missing) {
+		t.Fatalf("unexpected classification of %v", missing)
+	}
+	if refused := brokerError(amqp.ErrCredentials, nil); !errors.Is(refused, ErrAccessRefused) || Retryable(refused) {
+		t.Fatalf("unexpected classification of %v", refused)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialError(t *testing.T) {
+	refused := dialError(&net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	if !errors.Is(refused, ErrNotConnected) || errors.Is(refused, ErrTimeout) || !Retryable(refused) {
+		t.Fatalf("unexpected classification of %v", refused)
+	}
+	timeout := dialError(&net.OpError{Op: "dial", Err: timeoutError{}})
+	if !errors.Is(timeout, ErrNotConnected) || !errors.Is(timeout, ErrTimeout) || !Retryable(timeout) {
+		t.Fatalf("unexpected classification of %v", timeout)
+	}
+	if dialError(nil) != nil {
+		t.Fatal("expected nil")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for err, expected := range map[error]bool{
+		ErrNacked:                             true,
+		ErrBlocked:                            true,
+		ErrSpoolFull:                          true,
+		ErrUnroutable:                         false,
+		ErrUnconfirmed:                        false,
+		errors.New("invalid option"):          false,
+		&amqp.Error{Code: amqp.NotFound}:      false,
+		&amqp.Error{Code: amqp.ResourceError}: true,
+	} {
+		if Retryable(brokerError(err, nil)) != expected {
+			t.Errorf("expected Retryable(%v) to be %v", err, expected)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package message
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// FailoverSelection is the order the failover addresses are tried in
+type FailoverSelection int
+
+const (
+	// FailoverRoundRobin starts every connect at the address after the previous start
+	FailoverRoundRobin FailoverSelection = iota
+	// FailoverRandom tries the addresses in random order
+	FailoverRandom
+)
+
+const (
+	defaultFailoverBackoff    = time.Second
+	defaultFailoverMaxBackoff = 30 * time.Second
+)
+
+// FailoverConfig lists the cluster nodes a manager connects to
+type FailoverConfig struct {
+	// Addresses are the other nodes, the server address passed to the constructor is the first one
+	Addresses []string
+	// Selection is the order the addresses are tried in
+	Selection FailoverSelection
+	// Backoff is how long an address is skipped after a failed connect, it doubles with
+	// every failure up to MaxBackoff, defaults to one and 30 seconds
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// WithFailover connects to the first reachable node of a cluster, when the manager is created and
+// whenever the connection is lost, rounds that reach no node are Backoff apart until the manager
+// is closed. Sends fail while the manager reconnects, receivers resume consuming and the broker
+// redelivers what was not acked. Fanout receivers miss the messages sent while they reconnect
+// since their queue is temporary. The connected node is logged with FieldServer
+func WithFailover(config FailoverConfig) Option {
+	return func(o *options) {
+		if len(config.Addresses) == 0 {
+			o.setErr(errors.New("failover needs at least one address"))
+			return
+		}
+		if config.Backoff <= 0 {
+			config.Backoff = defaultFailoverBackoff
+		}
+		if config.MaxBackoff < config.Backoff {
+			config.MaxBackoff = defaultFailoverMaxBackoff
+			if config.MaxBackoff < config.Backoff {
+				config.MaxBackoff = config.Backoff
+			}
+		}
+		o.failover = &failover{
+			config: config,
+			rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+			now:    time.Now,
+		}
+	}
+}
+
+type failoverHost struct {
+	address  string
+	failures int
+	retryAt  time.Time
+}
+
+// failover keeps the backoff of every address of one manager
+type failover struct {
+	mu     sync.Mutex
+	config FailoverConfig
+	hosts  []*failoverHost
+	next   int
+	rand   *rand.Rand
+	now    func() time.Time
+}
+
+// order returns the addresses to try, the ones backing off are left out unless all of them are,
+// then the one whose backoff ends first is tried
+func (f *failover) order(serverAddress string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.hosts == nil {
+		f.init(serverAddress)
+	}
+
+	hosts := make([]*failoverHost, len(f.hosts))
+	switch f.config.Selection {
+	case FailoverRandom:
+		for i, j := range f.rand.Perm(len(f.hosts)) {
+			hosts[i] = f.hosts[j]
+		}
+	default:
+		for i := range f.hosts {
+			hosts[i] = f.hosts[(f.next+i)%len(f.hosts)]
+		}
+		f.next = (f.next + 1) % len(f.hosts)
+	}
+
+	now := f.now()
+	var addresses []string
+	var earliest *failoverHost
+	for _, h := range hosts {
+		if !now.Before(h.retryAt) {
+			addresses = append(addresses, h.address)
+		} else if earliest == nil || h.retryAt.Before(earliest.retryAt) {
+			earliest = h
+		}
+	}
+	if len(addresses) == 0 {
+		addresses = append(addresses, earliest.address)
+	}
+	return addresses
+}
+
+func (f *failover) init(serverAddress string) {
+	seen := map[string]bool{}
+	for _, address := range append([]string{serverAddress}, f.config.Addresses...) {
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+		f.hosts = append(f.hosts, &failoverHost{address: address})
+	}
+}
+
+// result records the outcome of a connect to address
+func (f *failover) result(address string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, h := range f.hosts {
+		if h.address != address {
+			continue
+		}
+		if err == nil {
+			h.failures = 0
+			h.retryAt = time.Time{}
+			return
+		}
+		backoff := f.config.Backoff << h.failures
+		if backoff > f.config.MaxBackoff || backoff <= 0 {
+			backoff = f.config.MaxBackoff
+		} else {
+			h.failures++
+		}
+		h.retryAt = f.now().Add(backoff)
+		return
+	}
+}
+
+// reconnect calls connect until it succeeds, false if done is closed first
+func (o *options) reconnect(done <-chan struct{}, connect func() error, keyvals ...interface{}) bool {
+	o.logger.Warn("Connection lost, reconnecting", keyvals...)
+	for {
+		select {
+		case <-done:
+			return false
+		default:
+		}
+		err := connect()
+		if err == nil {
+			o.logger.Info("Reconnected", keyvals...)
+			return true
+		}
+		o.logger.Warn("Failed to reconnect", append(keyvals, FieldError, err)...)
+		select {
+		case <-done:
+			return false
+		case <-time.After(o.failover.config.Backoff):
+		}
+	}
+}
+
+// notifyLost calls lost on its own goroutine when the broker or the network closes conn,
+// closing it with Close does not count
+func notifyLost(conn *amqp.Connection, lost func()) {
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err := <-closed; err != nil {
+			lost()
+		}
+	}()
+}
+
+// nodeName returns host:port of the address without the credentials
+func nodeName(address string) string {
+	uri, err := amqp.ParseURI(address)
+	if err != nil {
+		return "invalid address"
+	}
+	return net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port))
+}
@@ -0,0 +1,104 @@
+package message
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFailoverRoundRobinBackoff(t *testing.T) {
+	o := newOptions([]Option{WithFailover(FailoverConfig{
+		Addresses:  []string{"amqp://b", "amqp://c"},
+		Backoff:    time.Second,
+		MaxBackoff: 3 * time.Second,
+	})})
+	f := o.failover
+	now := time.Unix(0, 0)
+	f.now = func() time.Time { return now }
+
+	if order := fmt.Sprint(f.order("amqp://a")); order != "[amqp://a amqp://b amqp://c]" {
+		t.Fatalf("unexpected order %s", order)
+	}
+	if order := fmt.Sprint(f.order("amqp://a")); order != "[amqp://b amqp://c amqp://a]" {
+		t.Fatalf("unexpected order %s", order)
+	}
+
+	// b is skipped while backing off, 1s then 2s then capped at 3s
+	f.result("amqp://b", fmt.Errorf("refused"))
+	if order := fmt.Sprint(f.order("amqp://a")); order != "[amqp://c amqp://a]" {
+		t.Fatalf("unexpected order %s", order)
+	}
+	now = now.Add(time.Second)
+	f.result("amqp://b", fmt.Errorf("refused"))
+	f.result("amqp://b", fmt.Errorf("refused"))
+	if retry := f.hosts[1].retryAt.Sub(now); retry != 3*time.Second {
+		t.Fatalf("expected the backoff to be capped, got %v", retry)
+	}
+
+	// with every address backing off the one that is available first is tried
+	f.result("amqp://a", fmt.Errorf("refused"))
+	f.result("amqp://c", fmt.Errorf("refused"))
+	if order := fmt.Sprint(f.order("amqp://a")); order != "[amqp://a]" {
+		t.Fatalf("unexpected order %s", order)
+	}
+
+	f.result("amqp://b", nil)
+	if order := fmt.Sprint(f.order("amqp://a")); order != "[amqp://b]" {
+		t.Fatalf("unexpected order %s", order)
+	}
+}
+
+func TestFailoverDialTriesEveryNode(t *testing.T) {
+	// addresses of closed ports refuse the connection right away
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, "amqp://guest:guest@"+l.Addr().String()+"/")
+		l.Close()
+	}
+	o := newOptions([]Option{WithFailover(FailoverConfig{Addresses: addresses[1:], Selection: FailoverRandom})})
+	if _, err := o.dial(addresses[0]); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	for _, h := range o.failover.hosts {
+		if h.failures != 1 {
+			t.Fatalf("expected one failure for %s, got %d", h.address, h.failures)
+		}
+	}
+	if node := nodeName(addresses[0]); node != addresses[0][len("amqp://guest:guest@"):len(addresses[0])-1] {
+		t.Fatalf("unexpected node name %s", node)
+	}
+}
+
+func TestFailoverReconnect(t *testing.T) {
+	o := newOptions([]Option{WithLogger(NopLogger()), WithFailover(FailoverConfig{
+		Addresses: []string{"amqp://b"},
+		Backoff:   time.Millisecond,
+	})})
+	attempts := 0
+	ok := o.reconnect(nil, func() error {
+		attempts++
+		if attempts < 3 {
+			return ErrNotConnected
+		}
+		return nil
+	})
+	if !ok || attempts != 3 {
+		t.Fatalf("expected to reconnect on the third attempt, got %v after %d", ok, attempts)
+	}
+
+	done := make(chan struct{})
+	attempts = 0
+	ok = o.reconnect(done, func() error {
+		attempts++
+		close(done)
+		return ErrNotConnected
+	})
+	if ok || attempts != 1 {
+		t.Errorf("expected to give up once closed, got %v after %d", ok, attempts)
+	}
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrBlocked is returned by Send when the broker blocks publishers, in fail fast mode
+// or when the context is done before the broker unblocks, nothing was published
+var ErrBlocked = errors.New("publishing is blocked by the broker")
+
+// WithBlockedFailFast makes Send return ErrBlocked right away while the broker blocks the
+// connection or stops the channel flow, by default Send waits until the context is done
+func WithBlockedFailFast() Option {
+	return func(o *options) {
+		o.blockedFailFast = true
+	}
+}
+
+// flowControl tracks connection.blocked for memory and disk alarms and channel.flow
+type flowControl struct {
+	mu        sync.Mutex
+	blocked   bool
+	stopped   bool
+	unblocked chan struct{} // closed while publishing is allowed
+	options   *options
+	keyvals   []interface{}
+}
+
+func newFlowControl(o *options, keyvals ...interface{}) *flowControl {
+	f := &flowControl{unblocked: make(chan struct{}), options: o, keyvals: keyvals}
+	close(f.unblocked)
+	return f
+}
+
+// watch follows the notifications of a new connection and channel, a new connection starts unblocked
+func (f *flowControl) watch(conn *amqp.Connection, ch *amqp.Channel) {
+	f.update(func() { f.blocked, f.stopped = false, false })
+	blocks := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	flows := ch.NotifyFlow(make(chan bool, 1))
+	go func() {
+		for b := range blocks {
+			if b.Active {
+				f.options.logger.Warn("Connection blocked by the broker", append(f.keyvals, FieldError, b.Reason)...)
+				f.options.metrics.Add(MetricBlocked, 1, f.keyvals...)
+			} else {
+				f.options.logger.Info("Connection unblocked by the broker", f.keyvals...)
+			}
+			f.update(func() { f.blocked = b.Active })
+		}
+	}()
+	go func() {
+		for active := range flows {
+			if !active {
+				f.options.logger.Warn("Channel flow stopped by the broker", f.keyvals...)
+				f.options.metrics.Add(MetricFlowStopped, 1, f.keyvals...)
+			} else {
+				f.options.logger.Info("Channel flow resumed by the broker", f.keyvals...)
+			}
+			f.update(func() { f.stopped = !active })
+		}
+	}()
+}
+
+func (f *flowControl) update(change func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	wasBlocked := f.blocked || f.stopped
+	change()
+	isBlocked := f.blocked || f.stopped
+	switch {
+	case isBlocked && !wasBlocked:
+		f.unblocked = make(chan struct{})
+	case !isBlocked && wasBlocked:
+		close(f.unblocked)
+	}
+}
+
+// isBlocked reports whether the broker blocks publishing
+func (f *flowControl) isBlocked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.blocked || f.stopped
+}
+
+// wait blocks until publishing is allowed, the context is done or fails in fail fast mode
+func (f *flowControl) wait(ctx context.Context) error {
+	f.mu.Lock()
+	unblocked := f.unblocked
+	blocked := f.blocked || f.stopped
+	f.mu.Unlock()
+	if !blocked {
+		return nil
+	}
+	if f.options.blockedFailFast {
+		return ErrBlocked
+	}
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrBlocked, ctx.Err())
+	}
+}
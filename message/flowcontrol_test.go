@@ -0,0 +1,63 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestFlowControlWait(t *testing.T) {
+	f := newFlowControl(newOptions(nil))
+	if err := f.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.update(func() { f.blocked = true })
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := f.wait(ctx)
+	if !errors.Is(err, ErrBlocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected ErrBlocked after the deadline, got %v", err)
+	}
+
+	// both the alarm and the channel flow have to clear
+	f.update(func() { f.stopped = true })
+	f.update(func() { f.blocked = false })
+	if !f.isBlocked() {
+		t.Fatal("expected the stopped channel flow to keep blocking")
+	}
+	done := make(chan error)
+	go func() { done <- f.wait(context.Background()) }()
+	f.update(func() { f.stopped = false })
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after unblocking")
+	}
+}
+
+func TestFlowControlFailFast(t *testing.T) {
+	f := newFlowControl(newOptions([]Option{WithBlockedFailFast()}))
+	f.update(func() { f.blocked = true })
+	if err := f.wait(context.Background()); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("expected ErrBlocked, got %v", err)
+	}
+}
+
+func TestPublisherWaitsForInflightConfirm(t *testing.T) {
+	p := &publisher{inflight: make(chan struct{}, 1), confirms: make(chan amqp.Confirmation), options: newOptions(nil)}
+	// a message published earlier is still waiting for its confirm
+	p.inflight <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := p.publish(ctx, "", "test", amqp.Publishing{})
+	if !errors.Is(err, ErrBlocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected blocked and deadline exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package message
+
+import (
+	"fmt"
+	stdlog "log"
+	"log/slog"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/qulia/go-log/log"
+	"go.uber.org/zap"
+)
+
+// Keys used for the key/value pairs passed to Logger
+const (
+	FieldQueue          = "queue"
+	FieldExchange       = "exchange"
+	FieldSourceExchange = "source_exchange"
+	FieldDeliveryTag    = "delivery_tag"
+	FieldMessageID      = "message_id"
+	FieldLength         = "length"
+	FieldCount          = "count"
+	FieldError          = "error"
+	FieldServer         = "server"
+)
+
+// Logger is used by the managers to report what they are doing
+// keyvals are alternating key/value pairs, keys are one of the Field constants
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// defaultLogger keeps the go-log output format when no logger is given
+var defaultLogger Logger = goLogLogger{level: log.Verbose}
+
+// NewGoLogLogger writes in the go-log format with the caller of the manager, messages below level
+// are dropped. go-log itself cannot report the caller, so log.SetLevel does not apply to it
+func NewGoLogLogger(level log.Level) Logger {
+	return goLogLogger{level: level}
+}
+
+// NewSlogLogger adapts a log/slog logger, slog.Default() is used if l is nil
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
+
+// NewZapLogger adapts a zap logger, keyvals are passed as loosely typed fields, the global
+// zap.L() is used if l is nil
+func NewZapLogger(l *zap.Logger) Logger {
+	if l == nil {
+		l = zap.L()
+	}
+	return zapLogger{l.WithOptions(zap.AddCallerSkip(1)).Sugar()}
+}
+
+// NopLogger returns a logger that discards everything
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type zapLogger struct {
+	s *zap.SugaredLogger
+}
+
+func (z zapLogger) Debug(msg string, keyvals ...interface{}) { z.s.Debugw(msg, keyvals...) }
+func (z zapLogger) Info(msg string, keyvals ...interface{})  { z.s.Infow(msg, keyvals...) }
+func (z zapLogger) Warn(msg string, keyvals ...interface{})  { z.s.Warnw(msg, keyvals...) }
+func (z zapLogger) Error(msg string, keyvals ...interface{}) { z.s.Errorw(msg, keyvals...) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// goLogLogger writes in the go-log format, go-log always reports its direct caller so the
+// output is written here with the caller of the Logger method instead
+type goLogLogger struct {
+	level log.Level
+}
+
+func (g goLogLogger) Debug(msg string, keyvals ...interface{}) {
+	g.output(log.Verbose, formatKeyvals(msg, keyvals))
+}
+
+func (g goLogLogger) Info(msg string, keyvals ...interface{}) {
+	g.output(log.Verbose, formatKeyvals(msg, keyvals))
+}
+
+func (g goLogLogger) Warn(msg string, keyvals ...interface{}) {
+	g.output(log.Warning, formatKeyvals(msg, keyvals))
+}
+
+func (g goLogLogger) Error(msg string, keyvals ...interface{}) {
+	// go-log appends the error itself, so take it out of the fields
+	var err error
+	rest := make([]interface{}, 0, len(keyvals))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if e, ok := keyvals[i+1].(error); ok && keyvals[i] == FieldError {
+			err = e
+			continue
+		}
+		rest = append(rest, keyvals[i], keyvals[i+1])
+	}
+	line := formatKeyvals(msg, rest) + " "
+	if err != nil {
+		line += err.Error()
+	}
+	g.output(log.Error, line)
+}
+
+// output must be called directly from a goLogLogger method
+func (g goLogLogger) output(level log.Level, msg string) {
+	if g.level < level {
+		return
+	}
+	const depth = 3 // output, the goLogLogger method, its caller
+	_, file, line, _ := runtime.Caller(depth - 1)
+	if stdlog.Flags()&stdlog.Lshortfile != 0 {
+		file = path.Base(file)
+	}
+	stdlog.Output(depth, fmt.Sprintf("%s#%d: %s", file, line, msg))
+}
+
+func formatKeyvals(msg string, keyvals []interface{}) string {
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		sb.WriteString(" ")
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&sb, "%v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&sb, "%v=?", keyvals[i])
+		}
+	}
+	return sb.String()
+}
+
+// logFatal logs and exits, used by constructors that cannot return an error
+func logFatal(logger Logger, err error, msg string, keyvals ...interface{}) {
+	if err == nil {
+		return
+	}
+	logger.Error(msg, append(keyvals, FieldError, err)...)
+	os.Exit(1)
+}
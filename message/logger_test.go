@@ -0,0 +1,92 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	stdlog "log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/qulia/go-log/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSlogLoggerFields(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logger.Error("Failed sending message", FieldQueue, "q1", FieldDeliveryTag, uint64(7), FieldError, errors.New("boom"))
+
+	out := buf.String()
+	for _, want := range []string{"queue=q1", "delivery_tag=7", "error=boom"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in %q", want, out)
+		}
+	}
+}
+
+func TestZapLoggerFields(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	logger := NewZapLogger(zap.New(core))
+	logger.Debug("Received a message", FieldExchange, "ex1", FieldMessageID, "m1")
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields[FieldExchange] != "ex1" || fields[FieldMessageID] != "m1" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestWithLoggerNil(t *testing.T) {
+	o := newOptions([]Option{WithLogger(nil)})
+	if _, ok := o.logger.(nopLogger); !ok {
+		t.Errorf("expected nop logger, got %T", o.logger)
+	}
+}
+
+func TestDefaultLoggerCaller(t *testing.T) {
+	var buf bytes.Buffer
+	stdlog.SetOutput(&buf)
+	flags := stdlog.Flags()
+	stdlog.SetFlags(stdlog.Lshortfile)
+	defer func() {
+		stdlog.SetOutput(os.Stderr)
+		stdlog.SetFlags(flags)
+	}()
+
+	defaultLogger.Error("Failed sending message", FieldQueue, "q1", FieldError, errors.New("boom"))
+	if out := buf.String(); !strings.HasPrefix(out, "logger_test.go:") || !strings.Contains(out, "logger_test.go#") ||
+		!strings.Contains(out, "queue=q1 boom") {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	buf.Reset()
+	logger := NewGoLogLogger(log.Warning)
+	logger.Debug("Received a message")
+	logger.Warn("Delivery settled twice")
+	if out := buf.String(); strings.Contains(out, "Received") || !strings.Contains(out, "settled twice") {
+		t.Errorf("unexpected output %q", out)
+	}
+}
+
+func TestZapLoggerNil(t *testing.T) {
+	// the global logger is a no-op until it is replaced
+	if zap.L().Core().Enabled(zap.ErrorLevel) {
+		t.Fatal("expected the global zap logger to discard everything")
+	}
+	NewZapLogger(nil).Error("Connected")
+
+	core, logs := observer.New(zap.DebugLevel)
+	restore := zap.ReplaceGlobals(zap.New(core))
+	defer restore()
+	NewZapLogger(nil).Info("Connected", FieldServer, "node1")
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].ContextMap()[FieldServer] != "node1" {
+		t.Errorf("expected the entry on the global logger, got %v", entries)
+	}
+}
@@ -0,0 +1,136 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrUnroutable is returned by Send with WithMandatory when no queue received the message
+var ErrUnroutable = errors.New("message is unroutable")
+
+// WithMandatory publishes with the mandatory flag, the broker returns messages that no queue receives
+// With a nil onReturn Send waits for the broker and returns ErrUnroutable for a returned message,
+// publisher confirms are enabled and sends on the manager are serialized
+// Otherwise Send returns right after publishing and onReturn is called with the returned wire form
+func WithMandatory(onReturn func(amqp.Return)) Option {
+	return func(o *options) {
+		o.mandatory = true
+		o.onReturn = onReturn
+	}
+}
+
+// WithAlternateExchange declares the fanout exchanges with an alternate exchange that receives
+// the messages no queue is bound for, the alternate exchange is not declared by the manager
+// Every manager declaring the same exchange must use the same alternate exchange
+func WithAlternateExchange(exchange string) Option {
+	return func(o *options) {
+		if exchange == "" {
+			o.setErr(errors.New("alternate exchange name is empty"))
+			return
+		}
+		o.alternateExchange = exchange
+	}
+}
+
+// exchangeArguments returns the arguments the fanout exchanges are declared with
+func (o *options) exchangeArguments() amqp.Table {
+	if o.alternateExchange == "" {
+		return nil
+	}
+	return amqp.Table{"alternate-exchange": o.alternateExchange}
+}
+
+// publisher publishes on a channel, with WithMandatory it handles the returned messages
+type publisher struct {
+	// inflight holds a token while a message waits for its confirm
+	inflight chan struct{}
+	channel  *amqp.Channel
+	returns  chan amqp.Return
+	confirms chan amqp.Confirmation
+	options  *options
+}
+
+func newPublisher(ch *amqp.Channel, o *options) (*publisher, error) {
+	p := &publisher{inflight: make(chan struct{}, 1), channel: ch, options: o}
+	if !o.mandatory {
+		return p, nil
+	}
+	if o.onReturn != nil {
+		returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+		go func() {
+			for ret := range returns {
+				p.returned(&ret)
+				o.onReturn(ret)
+			}
+		}()
+		return p, nil
+	}
+
+	// the broker sends basic.return before the confirm of the same message
+	if err := ch.Confirm(false); err != nil {
+		return nil, brokerError(err, nil)
+	}
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return p, nil
+}
+
+// publish waits for its turn and then for the confirm until ctx is done
+// The error wraps ErrBlocked and ctx.Err() if the message was not published yet, ErrUnconfirmed
+// and ctx.Err() if it was, the outcome is then unknown
+func (p *publisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	if p.confirms == nil {
+		return brokerError(p.channel.Publish(exchange, key, p.options.mandatory, false, msg), nil)
+	}
+
+	// one message in flight at a time so a return belongs to the message just published
+	select {
+	case p.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrBlocked, ctx.Err())
+	}
+	if err := p.channel.Publish(exchange, key, true, false, msg); err != nil {
+		<-p.inflight
+		return brokerError(err, nil)
+	}
+	select {
+	case confirm, ok := <-p.confirms:
+		defer func() { <-p.inflight }()
+		return p.confirmed(confirm, ok, msg.MessageId)
+	case <-ctx.Done():
+		// the next message is published once the broker settled this one
+		go func() {
+			confirm, ok := <-p.confirms
+			p.confirmed(confirm, ok, msg.MessageId)
+			<-p.inflight
+		}()
+		return fmt.Errorf("%w: message %s: %w", ErrUnconfirmed, msg.MessageId, ctx.Err())
+	}
+}
+
+// confirmed returns the outcome of the message confirm belongs to
+func (p *publisher) confirmed(confirm amqp.Confirmation, ok bool, messageID string) error {
+	if !ok {
+		return brokerError(amqp.ErrClosed, nil)
+	}
+	select {
+	case ret := <-p.returns:
+		p.returned(&ret)
+		return fmt.Errorf("%w: %d %s", ErrUnroutable, ret.ReplyCode, ret.ReplyText)
+	default:
+	}
+	if !confirm.Ack {
+		return fmt.Errorf("%w: message %s", ErrNacked, messageID)
+	}
+	return nil
+}
+
+func (p *publisher) returned(ret *amqp.Return) {
+	keyvals := []interface{}{FieldExchange, ret.Exchange, FieldQueue, ret.RoutingKey}
+	p.options.logger.Warn("Message returned by the broker", append(keyvals,
+		FieldMessageID, ret.MessageId, FieldError, ret.ReplyText)...)
+	p.options.metrics.Add(MetricUnroutable, 1, keyvals...)
+}
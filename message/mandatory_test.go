@@ -0,0 +1,82 @@
+// Integration tests for mandatory publishing
+package message
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMandatoryUnroutable(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+	exchange := t.Name() + "Exchange"
+	fm := NewSendFanoutManager(serverAddress, exchange, WithMandatory(nil))
+	defer fm.Close()
+
+	// no queue is bound to the exchange
+	err = fm.Send(&amqp.Publishing{MessageId: "m1", Body: []byte("lost")})
+	if !errors.Is(err, ErrUnroutable) {
+		t.Fatalf("expected ErrUnroutable, got %v", err)
+	}
+
+	returned := make(chan amqp.Return, 1)
+	returning := NewSendFanoutManager(serverAddress, exchange, WithMandatory(func(ret amqp.Return) {
+		returned <- ret
+	}))
+	defer returning.Close()
+	if err := returning.Send(&amqp.Publishing{MessageId: "m2", Body: []byte("lost")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ret := <-returned:
+		if ret.MessageId != "m2" {
+			t.Fatalf("unexpected returned message %s", ret.MessageId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not returned")
+	}
+}
+
+func TestAlternateExchange(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+	admin, err := NewAdmin(serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	alternate := t.Name() + "Alternate"
+	if err := admin.ExchangeDeclare(alternate, "fanout", false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.QueueBind(t.Name(), "", alternate, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fm := NewSendFanoutManager(serverAddress, t.Name()+"Exchange",
+		WithMandatory(nil), WithAlternateExchange(alternate))
+	if err := fm.Send(&amqp.Publishing{Body: []byte("kept")}); err != nil {
+		t.Fatal(err)
+	}
+	waitExpectedCount(t.Name(), 1)
+}
+
+func TestExchangeArguments(t *testing.T) {
+	if args := newOptions(nil).exchangeArguments(); args != nil {
+		t.Fatalf("expected no arguments, got %v", args)
+	}
+	o := newOptions([]Option{WithAlternateExchange("unrouted")})
+	if o.exchangeArguments()["alternate-exchange"] != "unrouted" {
+		t.Fatalf("unexpected arguments %v", o.exchangeArguments())
+	}
+	if o := newOptions([]Option{WithAlternateExchange("")}); o.err == nil {
+		t.Fatal("expected an error for an empty alternate exchange")
+	}
+}
@@ -0,0 +1,43 @@
+package message
+
+// Names of the metrics reported to Metrics
+const (
+	// MetricSignatureRejected counts deliveries rejected because the signature is missing or invalid
+	MetricSignatureRejected = "signature_rejected"
+	// MetricSpoolDepth is the number of messages waiting in the spool
+	MetricSpoolDepth = "spool_depth"
+	// MetricSpoolBytes is the size of the messages waiting in the spool
+	MetricSpoolBytes = "spool_bytes"
+	// MetricUnroutable counts mandatory messages returned by the broker
+	MetricUnroutable = "unroutable"
+	// MetricBlocked counts the times the broker blocked the connection
+	MetricBlocked = "blocked"
+	// MetricFlowStopped counts the times the broker stopped the channel flow
+	MetricFlowStopped = "flow_stopped"
+	// MetricUnsettled counts deliveries not settled within the WithUnsettledTimeout
+	MetricUnsettled = "unsettled"
+)
+
+// Metrics receives the counters and gauges of the managers
+// keyvals are alternating key/value pairs identifying the source, keys are one of the Field constants
+type Metrics interface {
+	// Add increments the counter name by delta
+	Add(name string, delta int64, keyvals ...interface{})
+	// Set sets the gauge name to value
+	Set(name string, value int64, keyvals ...interface{})
+}
+
+// WithMetrics reports the manager's metrics to m
+func WithMetrics(m Metrics) Option {
+	return func(o *options) {
+		if m == nil {
+			m = nopMetrics{}
+		}
+		o.metrics = m
+	}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Add(string, int64, ...interface{}) {}
+func (nopMetrics) Set(string, int64, ...interface{}) {}
@@ -1,70 +1,103 @@
 package message
 
 import (
-	"github.com/qulia/go-log/log"
 	"github.com/streadway/amqp"
 )
 
 // NamedQueueManager Deals with RabbitMqQueue connection details
 type NamedQueueManager struct {
 	serverAddress string
+	queueName     string
+	conn          *amqp.Connection
 	queue         *amqp.Queue
 	channel       *amqp.Channel
+	options       *options
 }
 
-func NewNamedQueueManager(serverAddress, queueName string) (*NamedQueueManager, error) {
+func NewNamedQueueManager(serverAddress, queueName string, opts ...Option) (*NamedQueueManager, error) {
 	nqm := new(NamedQueueManager)
 	nqm.serverAddress = serverAddress
-	ch, q, err := getNamedQueue(serverAddress, queueName)
-	nqm.channel = ch
-	nqm.queue = q
+	nqm.queueName = queueName
+	nqm.options = newOptions(opts)
+	if nqm.options.err != nil {
+		return nil, nqm.options.err
+	}
+	err := nqm.connect()
 	return nqm, err
 }
 
-// GetCount returns number of messages in the queue
+// connect dials the server and declares the queue, replacing the previous connection
+func (qm *NamedQueueManager) connect() error {
+	conn, ch, q, err := getNamedQueue(qm.serverAddress, qm.queueName, qm.options)
+	if err != nil {
+		return err
+	}
+	if qm.conn != nil {
+		qm.conn.Close()
+	}
+	qm.conn, qm.channel, qm.queue = conn, ch, q
+	return nil
+}
+
+// name returns the declared queue name, or the requested one before the queue is declared
+func (qm *NamedQueueManager) name() string {
+	if qm.queue != nil {
+		return qm.queue.Name
+	}
+	return qm.queueName
+}
+
+// GetCount returns number of messages in the queue, 0 if the count cannot be read
+// Use Count to get the error
 func (qm *NamedQueueManager) GetCount() int {
-	q, _ := qm.channel.QueueDeclare(
-		qm.queue.Name, // server create the queue name if empty
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		nil,           // arguments
-	)
+	count, _ := qm.Count()
+	return count
+}
+
+// Count returns number of messages in the queue
+func (qm *NamedQueueManager) Count() (int, error) {
+	q, err := qm.options.declareQueue(qm.channel, qm.queue.Name)
+	if err != nil {
+		qm.options.logger.Error("Failed to get queue count", FieldQueue, qm.queue.Name, FieldError, err)
+	}
 
-	return q.Messages
+	return q.Messages, err
 }
 func (qm *NamedQueueManager) Close() error {
+	if qm.channel == nil {
+		return nil
+	}
 	err := qm.channel.Close()
-	log.E(err, "Failed closing the channel for %s\n", qm.queue.Name)
+	if err != nil {
+		qm.options.logger.Error("Failed closing the channel",
+			FieldQueue, qm.name(), FieldError, err)
+	}
+	if qm.conn != nil {
+		qm.conn.Close()
+	}
 	return err
 }
 
-func getNamedQueue(serverAddress, queueName string) (*amqp.Channel, *amqp.Queue, error) {
-	conn, err := amqp.Dial(serverAddress)
+func getNamedQueue(serverAddress, queueName string, o *options) (*amqp.Connection, *amqp.Channel, *amqp.Queue, error) {
+	conn, err := o.dial(serverAddress)
 	if err != nil {
-		log.E(err, "Failed to connect to RabbitMQ\n")
-		return nil, nil, err
+		o.logger.Error("Failed to connect to RabbitMQ", FieldError, err)
+		return nil, nil, nil, err
 	}
 
 	ch, err := conn.Channel()
 	if err != nil {
-		log.E(err, "Failed to open a channel\n")
-		return nil, nil, err
+		o.logger.Error("Failed to open a channel", FieldError, err)
+		conn.Close()
+		return nil, nil, nil, brokerError(err, nil)
 	}
 
-	q, err := ch.QueueDeclare(
-		queueName, // server create the queue name if empty
-		false,     // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
+	q, err := o.declareQueue(ch, queueName)
 
 	if err != nil {
-		log.E(err, "Failed to declare a queue\n")
-		return nil, nil, err
+		o.logger.Error("Failed to declare a queue", FieldQueue, queueName, FieldError, err)
+		conn.Close()
+		return nil, nil, nil, err
 	}
-	return ch, &q, err
+	return conn, ch, &q, err
 }
@@ -0,0 +1,125 @@
+package message
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Option configures optional behaviour of the managers
+type Option func(*options)
+
+// options holds the settings shared by all managers
+type options struct {
+	logger  Logger
+	wiretap *Wiretap
+
+	compression          string
+	compressionThreshold int
+	maxDecompressedSize  int
+	keys                 KeyProvider
+	signer               Signer
+	verifier             Verifier
+	signProperties       []SignedProperty
+	verifyProperties     []SignedProperty
+	blobs                BlobStore
+	claimThreshold       int
+	releaseRejected      bool
+
+	metrics Metrics
+
+	maxPriority          int
+	messageTTL           *time.Duration
+	maxLength            *int
+	maxLengthBytes       *int
+	overflow             Overflow
+	queueExpires         time.Duration
+	deadLetterExchange   string
+	deadLetterRoutingKey string
+	queueKind            QueueKind
+	durable              bool
+	singleActiveConsumer bool
+	consumerPriority     *int
+	onActive             func()
+	onInactive           func()
+	receiveRateLimit     *RateLimit
+	sendRateLimit        *RateLimit
+	sendRateFailFast     bool
+	spool                *SpoolConfig
+	mandatory            bool
+	onReturn             func(amqp.Return)
+	alternateExchange    string
+	blockedFailFast      bool
+	dialConfig           *amqp.Config
+	connectionName       string
+	failover             *failover
+	topology             *Topology
+	passive              bool
+	fanoutAck            bool
+	unsettledTimeout     time.Duration
+	ackBatchSize         int
+	ackBatchInterval     time.Duration
+	deliveryLimit        *int
+	prefetch             int
+	workers              int
+	streamOffset         StreamOffset
+	offsetStore          OffsetStore
+	offsetConsumer       string
+
+	// err is the first invalid option, returned by the constructors
+	err error
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		logger:  defaultLogger,
+		metrics: nopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.validateQueueArguments(); err != nil {
+		o.setErr(err)
+	}
+	return o
+}
+
+func (o *options) setErr(err error) {
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+// WithPrefetch limits the number of unacked deliveries the broker sends to a receiver,
+// 0 means no limit
+func WithPrefetch(count int) Option {
+	return func(o *options) {
+		o.prefetch = count
+	}
+}
+
+// WithWorkers handles deliveries on a fixed number of goroutines instead of one goroutine
+// per delivery, buffered deliveries with a higher priority are handled first
+// It needs manual ack and WithPrefetch, which bounds the buffered deliveries
+func WithWorkers(count int) Option {
+	return func(o *options) {
+		o.workers = count
+	}
+}
+
+// WithLogger sets the logger used by the manager
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = NopLogger()
+		}
+		o.logger = logger
+	}
+}
+
+// WithWiretap mirrors the messages the manager publishes or consumes to the wiretap
+func WithWiretap(w *Wiretap) Option {
+	return func(o *options) {
+		o.wiretap = w
+	}
+}
@@ -0,0 +1,100 @@
+// Integration and unit tests for message priorities
+package message
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestNamedQueuePriorityUnderBacklog(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+	admin, err := NewAdmin(serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	// the queue created by setup has no x-max-priority
+	_, err = admin.QueueDelete(t.Name(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.QueueDelete(t.Name(), false, false)
+
+	nqs, err := NewSendNamedQueueManager(serverAddress, t.Name(), WithMaxPriority(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := nqs.SendPriority([]byte("low"), 1); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := nqs.SendPriority([]byte("high"), 9); err != nil {
+			t.Error(err)
+		}
+	}
+	nqs.Close()
+
+	nqr, err := NewReceiveNamedQueueManager(serverAddress, t.Name(), false,
+		WithMaxPriority(10), WithPrefetch(1), WithWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	receiveComplete := make(chan bool)
+	go func() {
+		nqr.Receive(func(msg []byte) error {
+			received <- string(msg)
+			return nil
+		})
+		receiveComplete <- true
+	}()
+	for i := 0; i < 10; i++ {
+		msg := <-received
+		expected := "high"
+		if i >= 5 {
+			expected = "low"
+		}
+		if msg != expected {
+			t.Errorf("message %d: got %s, expected %s", i, msg, expected)
+		}
+	}
+	nqr.Close()
+	<-receiveComplete
+}
+
+func TestDeliveryQueuePrefersPriority(t *testing.T) {
+	q := newDeliveryQueue()
+	for tag, priority := range []uint8{1, 5, 1, 9, 5} {
+		q.push(amqp.Delivery{DeliveryTag: uint64(tag), Priority: priority})
+	}
+	var tags []uint64
+	for i := 0; i < 5; i++ {
+		d, ok := q.pop()
+		if !ok {
+			t.Fatal("queue closed")
+		}
+		tags = append(tags, d.DeliveryTag)
+	}
+	expected := []uint64{3, 1, 4, 0, 2}
+	for i := range expected {
+		if tags[i] != expected[i] {
+			t.Fatalf("got order %v, expected %v", tags, expected)
+		}
+	}
+
+	q.push(amqp.Delivery{DeliveryTag: 5})
+	var requeued []uint64
+	q.close(func(d *amqp.Delivery) { requeued = append(requeued, d.DeliveryTag) })
+	if _, ok := q.pop(); ok {
+		t.Error("expected closed queue to hand over buffered deliveries")
+	}
+	if len(requeued) != 1 || requeued[0] != 5 {
+		t.Errorf("expected buffered delivery to be requeued, got %v", requeued)
+	}
+}
@@ -0,0 +1,292 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// maxPriorityLimit is the highest x-max-priority RabbitMQ accepts
+const maxPriorityLimit = 255
+
+// QueueKind is the type of the named queue
+type QueueKind string
+
+// Queue kinds
+const (
+	// QueueClassic is a single node queue, the default
+	QueueClassic QueueKind = "classic"
+	// QueueQuorum is a replicated queue, always durable
+	QueueQuorum QueueKind = "quorum"
+	// QueueStream is an append only log that consumers read from an offset, always durable
+	QueueStream QueueKind = "stream"
+)
+
+// Overflow is what the queue does once it reaches its max length
+type Overflow string
+
+// Overflow policies
+const (
+	// OverflowDropHead drops or dead-letters the oldest messages, the default
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish rejects new messages
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX rejects new messages and dead-letters them
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// WithQueueKind declares the named queue as a classic, quorum or stream queue
+func WithQueueKind(kind QueueKind) Option {
+	return func(o *options) {
+		switch kind {
+		case QueueClassic, QueueQuorum, QueueStream:
+			o.queueKind = kind
+		default:
+			o.setErr(fmt.Errorf("unknown queue kind %q", kind))
+		}
+	}
+}
+
+// WithDurable declares the named queue durable so it survives a broker restart
+// Quorum and stream queues are always durable
+func WithDurable(durable bool) Option {
+	return func(o *options) {
+		o.durable = durable
+	}
+}
+
+// WithDeliveryLimit declares a quorum queue with x-delivery-limit, messages redelivered
+// more than limit times are dropped or dead-lettered
+func WithDeliveryLimit(limit int) Option {
+	return func(o *options) {
+		if limit < 0 {
+			o.setErr(fmt.Errorf("delivery limit %d is negative", limit))
+			return
+		}
+		o.deliveryLimit = &limit
+	}
+}
+
+// WithSingleActiveConsumer declares the named queue with x-single-active-consumer, only one of its
+// receivers gets deliveries at a time and the next one takes over when it goes away
+func WithSingleActiveConsumer() Option {
+	return func(o *options) {
+		o.singleActiveConsumer = true
+	}
+}
+
+// WithConsumerPriority consumes with x-priority, the broker delivers to the receivers with the
+// highest priority first and, with a single active consumer, makes the highest one active
+func WithConsumerPriority(priority int) Option {
+	return func(o *options) {
+		if priority < math.MinInt32 || priority > math.MaxInt32 {
+			o.setErr(fmt.Errorf("consumer priority %d is out of range", priority))
+			return
+		}
+		o.consumerPriority = &priority
+	}
+}
+
+// WithActivityCallbacks tells the receiver when it becomes or stops being the active consumer
+// RabbitMQ does not announce it, so onActive is called when the first delivery arrives and
+// onInactive when the consumer is cancelled or closed after being active, either can be nil
+// They are only called with WithSingleActiveConsumer, every consumer is active otherwise
+func WithActivityCallbacks(onActive, onInactive func()) Option {
+	return func(o *options) {
+		o.onActive = onActive
+		o.onInactive = onInactive
+	}
+}
+
+// WithMaxPriority declares the named queue with x-max-priority so messages with a higher
+// priority are delivered first, every manager of the queue must use the same value
+// RabbitMQ recommends keeping it below 10
+func WithMaxPriority(maxPriority int) Option {
+	return func(o *options) {
+		if maxPriority < 1 || maxPriority > maxPriorityLimit {
+			o.setErr(fmt.Errorf("max priority %d is not between 1 and %d", maxPriority, maxPriorityLimit))
+			return
+		}
+		o.maxPriority = maxPriority
+	}
+}
+
+// WithMessageTTL declares the queue with x-message-ttl, messages older than ttl are dropped
+// or dead-lettered, 0 expires messages that cannot be delivered immediately
+func WithMessageTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		if err := validateMilliseconds("message TTL", ttl, 0); err != nil {
+			o.setErr(err)
+			return
+		}
+		o.messageTTL = &ttl
+	}
+}
+
+// WithMaxLength declares the queue with x-max-length, the number of ready messages it keeps
+func WithMaxLength(count int) Option {
+	return func(o *options) {
+		if count < 0 {
+			o.setErr(fmt.Errorf("max length %d is negative", count))
+			return
+		}
+		o.maxLength = &count
+	}
+}
+
+// WithMaxLengthBytes declares the queue with x-max-length-bytes, the total body size of ready messages it keeps
+func WithMaxLengthBytes(size int) Option {
+	return func(o *options) {
+		if size < 0 {
+			o.setErr(fmt.Errorf("max length bytes %d is negative", size))
+			return
+		}
+		o.maxLengthBytes = &size
+	}
+}
+
+// WithOverflow declares the queue with x-overflow, it needs WithMaxLength or WithMaxLengthBytes
+func WithOverflow(overflow Overflow) Option {
+	return func(o *options) {
+		switch overflow {
+		case OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+			o.overflow = overflow
+		default:
+			o.setErr(fmt.Errorf("unknown overflow %q", overflow))
+		}
+	}
+}
+
+// WithQueueExpires declares the queue with x-expires, the queue is deleted after it is unused for expires
+func WithQueueExpires(expires time.Duration) Option {
+	return func(o *options) {
+		if err := validateMilliseconds("queue expires", expires, time.Millisecond); err != nil {
+			o.setErr(err)
+			return
+		}
+		o.queueExpires = expires
+	}
+}
+
+// WithDeadLetterExchange declares the queue with x-dead-letter-exchange, rejected and expired messages
+// are published to exchange, with routingKey if it is not empty
+// It applies to the named queues and to the temporary queue of the fanout receivers
+func WithDeadLetterExchange(exchange, routingKey string) Option {
+	return func(o *options) {
+		o.deadLetterExchange = exchange
+		o.deadLetterRoutingKey = routingKey
+	}
+}
+
+// validateQueueArguments checks the queue options that depend on each other
+func (o *options) validateQueueArguments() error {
+	if o.overflow != "" && o.maxLength == nil && o.maxLengthBytes == nil {
+		return errors.New("overflow needs a max length or max length bytes")
+	}
+	if o.deliveryLimit != nil && o.queueKind != QueueQuorum {
+		return errors.New("delivery limit needs a quorum queue")
+	}
+	if o.streamOffset.value != nil && o.queueKind != QueueStream {
+		return errors.New("stream offset needs a stream queue")
+	}
+	if o.offsetStore != nil && o.queueKind != QueueStream {
+		return errors.New("offset store needs a stream queue")
+	}
+	switch o.queueKind {
+	case QueueQuorum:
+		if o.maxPriority > 0 {
+			return errors.New("quorum queues do not support max priority")
+		}
+	case QueueStream:
+		if o.maxPriority > 0 || o.messageTTL != nil || o.overflow != "" || o.maxLength != nil || o.deadLetterExchange != "" {
+			return errors.New("stream queues do not support max priority, message TTL, max length, overflow or dead-lettering")
+		}
+	}
+	return nil
+}
+
+// queueArguments returns the arguments the named queue is declared with
+func (o *options) queueArguments() amqp.Table {
+	args := amqp.Table{}
+	if o.queueKind != "" && o.queueKind != QueueClassic {
+		args["x-queue-type"] = string(o.queueKind)
+	}
+	if o.deliveryLimit != nil {
+		args["x-delivery-limit"] = int64(*o.deliveryLimit)
+	}
+	if o.singleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if o.maxPriority > 0 {
+		args["x-max-priority"] = int32(o.maxPriority)
+	}
+	if o.messageTTL != nil {
+		args["x-message-ttl"] = o.messageTTL.Milliseconds()
+	}
+	if o.maxLength != nil {
+		args["x-max-length"] = int64(*o.maxLength)
+	}
+	if o.maxLengthBytes != nil {
+		args["x-max-length-bytes"] = int64(*o.maxLengthBytes)
+	}
+	if o.overflow != "" {
+		args["x-overflow"] = string(o.overflow)
+	}
+	if o.queueExpires > 0 {
+		args["x-expires"] = o.queueExpires.Milliseconds()
+	}
+	if o.deadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = o.deadLetterExchange
+		if o.deadLetterRoutingKey != "" {
+			args["x-dead-letter-routing-key"] = o.deadLetterRoutingKey
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// queueDurable is the durable flag the named queue is declared with
+func (o *options) queueDurable() bool {
+	return o.durable || o.queueKind == QueueQuorum || o.queueKind == QueueStream
+}
+
+// consumeArguments returns the arguments the receivers consume with, offset is where a stream
+// receiver starts
+func (o *options) consumeArguments(offset StreamOffset) amqp.Table {
+	args := amqp.Table{}
+	if offset.value != nil {
+		args[streamOffsetHeader] = offset.value
+	}
+	if o.consumerPriority != nil {
+		args["x-priority"] = int32(*o.consumerPriority)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// expiration formats a per message TTL for amqp.Publishing.Expiration
+func expiration(ttl time.Duration) (string, error) {
+	if err := validateMilliseconds("expiration", ttl, 0); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(ttl.Milliseconds(), 10), nil
+}
+
+// validateMilliseconds checks d is a whole number of milliseconds RabbitMQ accepts
+func validateMilliseconds(name string, d, min time.Duration) error {
+	if d < min || d.Milliseconds() > math.MaxUint32 {
+		return fmt.Errorf("%s %v is out of range", name, d)
+	}
+	if d%time.Millisecond != 0 {
+		return fmt.Errorf("%s %v is not a whole number of milliseconds", name, d)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package message
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestQueueArguments(t *testing.T) {
+	o := newOptions([]Option{
+		WithMessageTTL(30 * time.Second),
+		WithMaxLength(1000),
+		WithMaxLengthBytes(1 << 20),
+		WithOverflow(OverflowRejectPublishDLX),
+		WithQueueExpires(time.Hour),
+		WithMaxPriority(5),
+	})
+	if o.err != nil {
+		t.Fatal(o.err)
+	}
+	expected := amqp.Table{
+		"x-message-ttl":      int64(30000),
+		"x-max-length":       int64(1000),
+		"x-max-length-bytes": int64(1 << 20),
+		"x-overflow":         "reject-publish-dlx",
+		"x-expires":          int64(3600000),
+		"x-max-priority":     int32(5),
+	}
+	if args := o.queueArguments(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("got %v, expected %v", args, expected)
+	}
+	if err := o.queueArguments().Validate(); err != nil {
+		t.Error(err)
+	}
+	o = newOptions([]Option{WithDeadLetterExchange("quarantine", "rejected")})
+	expected = amqp.Table{"x-dead-letter-exchange": "quarantine", "x-dead-letter-routing-key": "rejected"}
+	if args := o.queueArguments(); !reflect.DeepEqual(args, expected) {
+		t.Errorf("got %v, expected %v", args, expected)
+	}
+	if args := newOptions(nil).queueArguments(); args != nil {
+		t.Errorf("expected no arguments, got %v", args)
+	}
+}
+
+func TestQueueArgumentsValidation(t *testing.T) {
+	invalid := [][]Option{
+		{WithMessageTTL(-time.Second)},
+		{WithMessageTTL(1500 * time.Microsecond)},
+		{WithMaxLength(-1)},
+		{WithOverflow("drop-tail")},
+		{WithOverflow(OverflowRejectPublish)},
+		{WithQueueExpires(0)},
+		{WithMaxPriority(256)},
+	}
+	for _, opts := range invalid {
+		if o := newOptions(opts); o.err == nil {
+			t.Errorf("expected error for %v", o.queueArguments())
+		}
+	}
+	if _, err := expiration(-time.Millisecond); err == nil {
+		t.Error("expected error for negative expiration")
+	}
+	if exp, _ := expiration(1500 * time.Millisecond); exp != "1500" {
+		t.Errorf("unexpected expiration %q", exp)
+	}
+}
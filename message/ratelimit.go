@@ -0,0 +1,87 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by Send when the send rate limit is exceeded in fail fast mode
+var ErrRateLimited = errors.New("send rate limit exceeded")
+
+// RateLimit is a token bucket that can be shared by managers and changed while they use it
+type RateLimit struct {
+	limiter *rate.Limiter
+}
+
+// NewRateLimit allows perSecond messages on average with bursts of up to burst messages
+func NewRateLimit(perSecond float64, burst int) (*RateLimit, error) {
+	if err := validateRateLimit(perSecond, burst); err != nil {
+		return nil, err
+	}
+	return &RateLimit{limiter: rate.NewLimiter(rate.Limit(perSecond), burst)}, nil
+}
+
+// Set changes the limit for later sends and deliveries, those already waiting keep the delay
+// they reserved under the old limit
+func (rl *RateLimit) Set(perSecond float64, burst int) error {
+	if err := validateRateLimit(perSecond, burst); err != nil {
+		return err
+	}
+	rl.limiter.SetLimit(rate.Limit(perSecond))
+	rl.limiter.SetBurst(burst)
+	return nil
+}
+
+// Limit returns the current messages per second and burst
+func (rl *RateLimit) Limit() (float64, int) {
+	return float64(rl.limiter.Limit()), rl.limiter.Burst()
+}
+
+func validateRateLimit(perSecond float64, burst int) error {
+	if perSecond <= 0 || burst < 1 {
+		return fmt.Errorf("invalid rate limit %v/s with burst %d", perSecond, burst)
+	}
+	return nil
+}
+
+// WithReceiveRateLimit throttles how fast the receiver calls its handler, deliveries waiting
+// for the limit stay unacked so the broker stops sending once the prefetch is reached
+func WithReceiveRateLimit(limit *RateLimit) Option {
+	return func(o *options) {
+		o.receiveRateLimit = limit
+	}
+}
+
+// WithSendRateLimit throttles Send, it waits for the limit or returns ErrRateLimited if failFast is set
+func WithSendRateLimit(limit *RateLimit, failFast bool) Option {
+	return func(o *options) {
+		o.sendRateLimit = limit
+		o.sendRateFailFast = failFast
+	}
+}
+
+// waitReceive blocks until the receiver may call its handler
+func (o *options) waitReceive() {
+	if o.receiveRateLimit == nil {
+		return
+	}
+	// burst is at least 1 and the limit above 0 so Wait cannot fail without a deadline
+	o.receiveRateLimit.limiter.Wait(context.Background())
+}
+
+// waitSend blocks until the sender may publish or the context is done, or fails in fail fast mode
+func (o *options) waitSend(ctx context.Context) error {
+	if o.sendRateLimit == nil {
+		return nil
+	}
+	if o.sendRateFailFast {
+		if !o.sendRateLimit.limiter.Allow() {
+			return ErrRateLimited
+		}
+		return nil
+	}
+	return o.sendRateLimit.limiter.Wait(ctx)
+}
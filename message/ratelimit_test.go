@@ -0,0 +1,53 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendRateLimitFailFast(t *testing.T) {
+	limit, err := NewRateLimit(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := newOptions([]Option{WithSendRateLimit(limit, true)})
+	for i := 0; i < 2; i++ {
+		if err := o.waitSend(context.Background()); err != nil {
+			t.Fatalf("send %d within burst failed: %v", i, err)
+		}
+	}
+	if err := o.waitSend(context.Background()); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestReceiveRateLimitChangesAtRuntime(t *testing.T) {
+	limit, _ := NewRateLimit(1000, 1)
+	o := newOptions([]Option{WithReceiveRateLimit(limit)})
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		o.waitReceive()
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("10 messages at 1000/s took %v", elapsed)
+	}
+
+	if err := limit.Set(20, 1); err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		o.waitReceive()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("5 messages at 20/s took %v", elapsed)
+	}
+	if perSecond, burst := limit.Limit(); perSecond != 20 || burst != 1 {
+		t.Errorf("unexpected limit %v/%d", perSecond, burst)
+	}
+	if err := limit.Set(0, 1); err == nil {
+		t.Error("expected error for zero rate")
+	}
+}
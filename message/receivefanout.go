@@ -1,57 +1,133 @@
 package message
 
 import (
-	"github.com/qulia/go-log/log"
+	"fmt"
 
 	"github.com/streadway/amqp"
 )
 
 // ReceiveFanoutManager supports receive/send and explicit send
 type ReceiveFanoutManager struct {
+	conn           *amqp.Connection
 	receiveChannel *amqp.Channel
 	receiveQueue   *amqp.Queue
+	receiveFanout  string
+	serverAddress  string
 	onReceive      func(*amqp.Delivery)
+	options        *options
+}
+
+// WithFanoutAck makes the fanout receivers ack each message after the handler returns instead of
+// consuming with auto ack, messages that fail to decode are rejected and can be quarantined with
+// WithDeadLetterExchange. Without it such messages are logged and dropped
+func WithFanoutAck() Option {
+	return func(o *options) {
+		o.fanoutAck = true
+	}
 }
 
 //NewReceiveFanoutManager creates new manager
 func NewReceiveFanoutManager(serverAddress, receiveFanout string,
-	onReceive func(*amqp.Delivery)) *ReceiveFanoutManager {
+	onReceive func(*amqp.Delivery), opts ...Option) *ReceiveFanoutManager {
 
 	rfm := new(ReceiveFanoutManager)
 	rfm.onReceive = onReceive
-	conn, err := amqp.Dial(serverAddress)
-	log.F(err, "Failed to connect to RabbitMQ\n")
-
-	ch, err := conn.Channel()
-	log.F(err, "Failed to open a channel\n")
-	err = ch.ExchangeDeclare(
-		receiveFanout,
-		"fanout", //kind string,
-		false,    //durable bool,
-		false,    //autoDelete bool,
-		false,    //internal bool,
-		false,    //noWait bool,
-		nil)      //args amqp.Table)
-	log.F(err, "Failed to declare exchange\n")
-	rfm.receiveChannel = ch
-	q, err := ch.QueueDeclare("", false, true /*autoDelete*/, false, false, nil)
-	log.F(err, "Failed to get queue\n")
-	err = ch.QueueBind(q.Name, "", receiveFanout, false, nil)
-	log.F(err, "Failed to bind to queue %s\n", q.Name)
-	rfm.receiveQueue = &q
+	rfm.receiveFanout = receiveFanout
+	rfm.options = newOptions(opts)
+	logger := rfm.options.logger
+	logFatal(logger, rfm.options.err, "Invalid option")
+	rfm.serverAddress = serverAddress
+	failMsg, err := rfm.connect()
+	logFatal(logger, err, failMsg, FieldExchange, receiveFanout)
 
 	go rfm.receive()
 
 	return rfm
 }
 
+// connect dials and binds a new temporary queue to the exchange, failMsg describes the failed step
+func (rfm *ReceiveFanoutManager) connect() (failMsg string, err error) {
+	conn, err := rfm.options.dial(rfm.serverAddress)
+	if err != nil {
+		return "Failed to connect to RabbitMQ", err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	ch, err := conn.Channel()
+	if err != nil {
+		return "Failed to open a channel", brokerError(err, nil)
+	}
+	if err = rfm.options.declareExchange(ch, rfm.receiveFanout); err != nil {
+		return "Failed to declare exchange", err
+	}
+	args := rfm.options.queueArguments()
+	q, err := ch.QueueDeclare("", false, true /*autoDelete*/, false, false, args)
+	if err != nil {
+		return "Failed to get queue", brokerError(err, args)
+	}
+	if err = ch.QueueBind(q.Name, "", rfm.receiveFanout, false, nil); err != nil {
+		return "Failed to bind to queue", brokerError(err, nil)
+	}
+	if rfm.conn != nil {
+		rfm.conn.Close()
+	}
+	rfm.conn, rfm.receiveChannel, rfm.receiveQueue = conn, ch, &q
+	return "", nil
+}
+
+// receive consumes until the connection is lost, with WithFailover it then reconnects and
+// consumes from a new temporary queue
 func (rfm *ReceiveFanoutManager) receive() {
-	msgs, _ := rfm.receiveChannel.Consume(
-		rfm.receiveQueue.Name, "", true /*autoAck*/, false, false, false, nil)
+	for {
+		rfm.consume()
+		if rfm.options.failover == nil {
+			return
+		}
+		rfm.options.reconnect(nil, func() error {
+			failMsg, err := rfm.connect()
+			if err != nil {
+				return fmt.Errorf("%s: %w", failMsg, err)
+			}
+			return nil
+		}, FieldExchange, rfm.receiveFanout)
+	}
+}
 
+func (rfm *ReceiveFanoutManager) consume() {
+	autoAck := !rfm.options.fanoutAck
+	logger := rfm.options.logger
+	msgs, err := rfm.receiveChannel.Consume(
+		rfm.receiveQueue.Name, "", autoAck, false, false, false, nil)
+	if err != nil {
+		logger.Error("Cannot consume from queue", FieldExchange, rfm.receiveFanout,
+			FieldQueue, rfm.receiveQueue.Name, FieldError, err)
+		return
+	}
 	for msg := range msgs {
 		msg := msg
-		log.V("Received message on receive fanout")
+		logger.Debug("Received message on receive fanout", FieldExchange, rfm.receiveFanout,
+			FieldQueue, rfm.receiveQueue.Name, FieldDeliveryTag, msg.DeliveryTag, FieldMessageID, msg.MessageId)
+		rfm.options.wiretap.tapDelivery(&msg, rfm.receiveFanout)
+		if err := rfm.options.decodeDelivery(&msg, FieldExchange, rfm.receiveFanout); err != nil {
+			if autoAck {
+				logger.Error("Dropping message", FieldExchange, rfm.receiveFanout,
+					FieldDeliveryTag, msg.DeliveryTag, FieldMessageID, msg.MessageId, FieldError, err)
+			} else {
+				rejectDelivery(logger, &msg, err, FieldExchange, rfm.receiveFanout)
+			}
+			continue
+		}
+		rfm.options.waitReceive()
 		rfm.onReceive(&msg)
+		if autoAck {
+			continue
+		}
+		if err := msg.Ack(false); err != nil {
+			logger.Error("Cannot ACK the message", FieldExchange, rfm.receiveFanout,
+				FieldDeliveryTag, msg.DeliveryTag, FieldMessageID, msg.MessageId, FieldError, err)
+		}
 	}
 }
@@ -1,7 +1,9 @@
 package message
 
 import (
-	"github.com/qulia/go-log/log"
+	"errors"
+	"sync"
+
 	"github.com/streadway/amqp"
 )
 
@@ -9,61 +11,315 @@ import (
 type ReceiveNamedQueueManager struct {
 	namedQueueManager *NamedQueueManager
 	autoAck           bool
+	prefetch          int
+	startOffset       StreamOffset
 	msgs              <-chan amqp.Delivery
+	stream            *streamTracker
+	unsettled         int64
+
+	// mu guards the connection and the ack batcher, which are replaced on reconnect,
+	// acks only batches the deliveries of acksOn
+	mu     sync.Mutex
+	acks   *ackBatcher
+	acksOn *amqp.Channel
+	closed bool
+	done   chan struct{}
 }
 
 // Receive is used to receive messages
 // Runs until is set
 // Calls onReceive on each message
 func (rnqm *ReceiveNamedQueueManager) Receive(onReceive func([]byte) error) {
+	rnqm.ReceiveDelivery(func(delivery *amqp.Delivery) error {
+		return onReceive(delivery.Body)
+	})
+}
+
+// ReceiveDelivery is the same as Receive but onReceive gets the whole delivery
+// including the properties and headers
+func (rnqm *ReceiveNamedQueueManager) ReceiveDelivery(onReceive func(*amqp.Delivery) error) {
+	rnqm.ReceiveSettle(func(delivery *Delivery) error {
+		return onReceive(delivery.Delivery)
+	})
+}
+
+// ReceiveSettle is the same as ReceiveDelivery but onReceive can settle the delivery itself with
+// Ack, Nack or Reject, or call Defer and settle it after returning
+func (rnqm *ReceiveNamedQueueManager) ReceiveSettle(onReceive func(*Delivery) error) {
+	options := rnqm.namedQueueManager.options
+	var workers *deliveryQueue
+	var wg sync.WaitGroup
+	if options.workers > 0 {
+		workers = newDeliveryQueue()
+		for i := 0; i < options.workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					// take the token first so the highest priority delivery is popped once allowed
+					options.waitReceive()
+					delivery, ok := workers.pop()
+					if !ok {
+						return
+					}
+					rnqm.handle(delivery, onReceive)
+				}
+			}()
+		}
+	}
+
+	active := false
 	for msg := range rnqm.msgs {
-		log.V("Received a message on queue %s with length %d\n",
-			rnqm.namedQueueManager.queue.Name, len(msg.Body))
-		go func(delivery amqp.Delivery) {
+		rnqm.received(&msg, &active)
+		if workers != nil {
+			workers.push(msg)
+		} else {
 			// TODO: For now, serialize per message
 			//  add support fan-out/fan-in for single message processing
-			err := onReceive(delivery.Body)
-			if !rnqm.autoAck {
-				if err == nil {
-					err := delivery.Ack(false) // TODO: ACK does not work with *amqp.Delivery
-					log.E(err, "Cannot ACK the message\n")
-				} else {
-					err := delivery.Nack(false, true /*requeue*/)
-					log.E(err, "Cannot NACK the message\n")
-				}
-			}
-		}(msg)
+			options.waitReceive()
+			go rnqm.handle(msg, onReceive)
+		}
+	}
+
+	if workers != nil {
+		workers.close(rnqm.requeue)
+		wg.Wait()
+	}
+	rnqm.stopped(active)
+}
+
+// received tracks a delivery taken from the consumer, with WithSingleActiveConsumer the first
+// one makes the consumer active
+func (rnqm *ReceiveNamedQueueManager) received(msg *amqp.Delivery, active *bool) {
+	options := rnqm.namedQueueManager.options
+	queueName := rnqm.namedQueueManager.queue.Name
+	if options.singleActiveConsumer && !*active {
+		*active = true
+		options.logger.Info("Consumer is active", FieldQueue, queueName)
+		if options.onActive != nil {
+			options.onActive()
+		}
+	}
+	options.logger.Debug("Received a message", FieldQueue, queueName,
+		FieldDeliveryTag, msg.DeliveryTag, FieldMessageID, msg.MessageId, FieldLength, len(msg.Body))
+	options.wiretap.tapDelivery(msg, queueName)
+	rnqm.stream.delivered(msg)
+	rnqm.batcher(msg).received(msg.DeliveryTag)
+}
+
+// batcher returns the ack batcher of the channel msg was delivered on, nil if acks are not
+// batched or the channel was replaced
+func (rnqm *ReceiveNamedQueueManager) batcher(msg *amqp.Delivery) *ackBatcher {
+	rnqm.mu.Lock()
+	defer rnqm.mu.Unlock()
+	if rnqm.acks == nil || msg.Acknowledger != rnqm.acksOn {
+		return nil
 	}
+	return rnqm.acks
+}
+
+// requeue returns a delivery that was never handed to the handler, once the channel is
+// closed the broker requeues it anyway
+func (rnqm *ReceiveNamedQueueManager) requeue(msg *amqp.Delivery) {
+	if err := msg.Nack(false, true); err != nil {
+		rnqm.namedQueueManager.options.logger.Debug("Cannot requeue the message",
+			FieldQueue, rnqm.namedQueueManager.queue.Name, FieldDeliveryTag, msg.DeliveryTag, FieldMessageID, msg.MessageId, FieldError, err)
+	}
+	rnqm.batcher(msg).settled(msg.DeliveryTag)
+}
+
+// stopped is called when the consumer's delivery channel is closed, active is only set with WithSingleActiveConsumer
+func (rnqm *ReceiveNamedQueueManager) stopped(active bool) {
+	options := rnqm.namedQueueManager.options
+	if active {
+		options.logger.Info("Consumer is no longer active", FieldQueue, rnqm.namedQueueManager.queue.Name)
+		if options.onInactive != nil {
+			options.onInactive()
+		}
+	}
+}
+
+// handle decodes the delivery, calls onReceive and settles the delivery
+func (rnqm *ReceiveNamedQueueManager) handle(delivery amqp.Delivery, onReceive func(*Delivery) error) {
+	if d := rnqm.decode(delivery); d != nil {
+		d.settleOnReturn(onReceive(d))
+	}
+}
+
+// decode decodes the delivery for the handler, a delivery that cannot be decoded is rejected and nil returned
+func (rnqm *ReceiveNamedQueueManager) decode(delivery amqp.Delivery) *Delivery {
+	options := rnqm.namedQueueManager.options
+	logger := options.logger
+	queueName := rnqm.namedQueueManager.queue.Name
+	claim := claimKey(delivery.Headers)
+	offset, tracked := streamOffsetOf(&delivery)
+	tracked = tracked && rnqm.stream != nil
+	if err := options.decodeDelivery(&delivery, FieldQueue, queueName); err != nil {
+		if tracked {
+			defer rnqm.stream.settled(offset)
+		}
+		if rnqm.autoAck {
+			logger.Error("Dropping message", FieldQueue, queueName, FieldDeliveryTag, delivery.DeliveryTag,
+				FieldMessageID, delivery.MessageId, FieldError, err)
+		} else {
+			rejectDelivery(logger, &delivery, err, FieldQueue, queueName)
+			rnqm.batcher(&delivery).settled(delivery.DeliveryTag)
+		}
+		return nil
+	}
+	return rnqm.newDelivery(&delivery, claim, offset, tracked)
 }
 
 // NewReceiveNamedQueueManager Create new queuemanager for sending and receiving data
-func NewReceiveNamedQueueManager(serverAddress, queueName string, autoAck bool) (*ReceiveNamedQueueManager, error) {
+func NewReceiveNamedQueueManager(serverAddress, queueName string, autoAck bool, opts ...Option) (*ReceiveNamedQueueManager, error) {
 	rnqm := new(ReceiveNamedQueueManager)
 	rnqm.autoAck = autoAck
-	nqm, err := NewNamedQueueManager(serverAddress, queueName)
+	nqm, err := NewNamedQueueManager(serverAddress, queueName, opts...)
 	if err != nil {
 		return nil, err
 	}
 	rnqm.namedQueueManager = nqm
-	msgs, err := nqm.channel.Consume(
+	prefetch := nqm.options.prefetch
+	offset := nqm.options.streamOffset
+	if nqm.options.queueKind == QueueStream {
+		if autoAck {
+			nqm.Close()
+			return nil, errors.New("stream queues need manual ack")
+		}
+		if offset, err = rnqm.startStream(); err != nil {
+			nqm.Close()
+			return nil, err
+		}
+		if prefetch == 0 {
+			prefetch = defaultStreamPrefetch
+		}
+	}
+	if nqm.options.workers > 0 && (autoAck || prefetch == 0) {
+		nqm.Close()
+		return nil, errors.New("workers need manual ack and a prefetch to bound the buffered deliveries")
+	}
+	rnqm.prefetch = prefetch
+	rnqm.startOffset = offset
+	msgs, err := rnqm.consume(nqm.channel, offset)
+	if err != nil {
+		nqm.Close()
+		return nil, err
+	}
+	rnqm.useChannel(nqm.channel)
+	rnqm.done = make(chan struct{})
+	if nqm.options.failover != nil {
+		deliveries := make(chan amqp.Delivery)
+		rnqm.msgs = deliveries
+		go rnqm.forward(msgs, deliveries)
+	} else {
+		rnqm.msgs = msgs
+	}
+	return rnqm, nil
+}
+
+// consume sets the prefetch and starts consuming on ch
+func (rnqm *ReceiveNamedQueueManager) consume(ch *amqp.Channel, offset StreamOffset) (<-chan amqp.Delivery, error) {
+	nqm := rnqm.namedQueueManager
+	if rnqm.prefetch > 0 {
+		if err := ch.Qos(rnqm.prefetch, 0, false); err != nil {
+			nqm.options.logger.Error("Cannot set prefetch", FieldQueue, nqm.queue.Name, FieldError, err)
+			return nil, brokerError(err, nil)
+		}
+	}
+	args := nqm.options.consumeArguments(offset)
+	msgs, err := ch.Consume(
 		nqm.queue.Name, // queue
 		"",             // consumer
 		rnqm.autoAck,   // auto-ack
 		false,          // exclusive
 		false,          // no-local
 		false,          // no-wait
-		nil,            // args
+		args,           // args
 	)
 	if err != nil {
-		log.E(err, "Cannot open channel for read %s\n", nqm.queue.Name)
+		nqm.options.logger.Error("Cannot open channel for read", FieldQueue, nqm.queue.Name, FieldError, err)
+		return nil, brokerError(err, args)
+	}
+	return msgs, nil
+}
+
+// useChannel batches the acks of the deliveries of ch and returns the batcher of the previous
+// channel, which the caller closes after releasing mu. mu must be held
+func (rnqm *ReceiveNamedQueueManager) useChannel(ch *amqp.Channel) *ackBatcher {
+	o := rnqm.namedQueueManager.options
+	if o.ackBatchSize == 0 || rnqm.autoAck {
+		return nil
+	}
+	previous := rnqm.acks
+	rnqm.acks = newAckBatcher(ch.Ack, o, FieldQueue, rnqm.namedQueueManager.queue.Name)
+	rnqm.acksOn = ch
+	return previous
+}
+
+// forward passes the deliveries on to out across reconnects, used with WithFailover
+func (rnqm *ReceiveNamedQueueManager) forward(msgs <-chan amqp.Delivery, out chan<- amqp.Delivery) {
+	defer close(out)
+	nqm := rnqm.namedQueueManager
+	for {
+		for msg := range msgs {
+			select {
+			case out <- msg:
+			case <-rnqm.done:
+				return
+			}
+		}
+		reconnected := nqm.options.reconnect(rnqm.done, func() error {
+			var err error
+			msgs, err = rnqm.reconnect()
+			return err
+		}, FieldQueue, nqm.name())
+		if !reconnected {
+			return
+		}
+	}
+}
+
+// reconnect replaces the connection and consumes from where the stream was left
+func (rnqm *ReceiveNamedQueueManager) reconnect() (<-chan amqp.Delivery, error) {
+	nqm := rnqm.namedQueueManager
+	conn, ch, q, err := getNamedQueue(nqm.serverAddress, nqm.queueName, nqm.options)
+	if err != nil {
 		return nil, err
 	}
-	rnqm.msgs = msgs
-	return rnqm, nil
+	offset := rnqm.startOffset
+	if next, ok := rnqm.Offset(); ok && next > 0 {
+		offset = StreamAt(next)
+	}
+	msgs, err := rnqm.consume(ch, offset)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	rnqm.mu.Lock()
+	if rnqm.closed {
+		rnqm.mu.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	previous := nqm.conn
+	nqm.conn, nqm.channel, nqm.queue = conn, ch, q
+	acks := rnqm.useChannel(ch)
+	rnqm.mu.Unlock()
+	previous.Close()
+	acks.close()
+	return msgs, nil
 }
 
 // Close the queue manager
 func (rnqm *ReceiveNamedQueueManager) Close() error {
+	rnqm.mu.Lock()
+	if !rnqm.closed {
+		rnqm.closed = true
+		close(rnqm.done)
+	}
+	acks := rnqm.acks
+	rnqm.mu.Unlock()
+	acks.close()
 	return rnqm.namedQueueManager.Close()
 }
 
@@ -1,48 +1,155 @@
 package message
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"sync"
+	"time"
 
-	"github.com/qulia/go-log/log"
 	"github.com/streadway/amqp"
 )
 
 // SendFanoutManager supports receive/send and explicit send
 type SendFanoutManager struct {
-	sendChannel *amqp.Channel
-	sendFanout  string
+	// mu guards the connection and the publisher, which are replaced on reconnect
+	mu            sync.RWMutex
+	serverAddress string
+	conn          *amqp.Connection
+	sendChannel   *amqp.Channel
+	publisher     *publisher
+	flow          *flowControl
+	sendFanout    string
+	options       *options
+	done          chan struct{}
 }
 
 //NewSendFanoutManager creates new manager
-func NewSendFanoutManager(serverAddress, sendFanout string) *SendFanoutManager {
+func NewSendFanoutManager(serverAddress, sendFanout string, opts ...Option) *SendFanoutManager {
 	fm := new(SendFanoutManager)
-	conn, err := amqp.Dial(serverAddress)
-	log.F(err, "Failed to connect to RabbitMQ")
+	fm.options = newOptions(opts)
+	logger := fm.options.logger
+	logFatal(logger, fm.options.err, "Invalid option")
+	conn, err := fm.options.dial(serverAddress)
+	logFatal(logger, err, "Failed to connect to RabbitMQ")
 
 	ch, err := conn.Channel()
-	log.F(err, "Failed to open a channel")
-	err = ch.ExchangeDeclare(
-		sendFanout,
-		"fanout", //kind string,
-		false,    //durable bool,
-		false,    //autoDelete bool,
-		false,    //internal bool,
-		false,    //noWait bool,
-		nil)      //args amqp.Table)
-	log.F(err, "Failed to declare exhange")
+	logFatal(logger, err, "Failed to open a channel")
+	err = fm.options.declareExchange(ch, sendFanout)
+	logFatal(logger, err, "Failed to declare exchange", FieldExchange, sendFanout)
+	fm.publisher, err = newPublisher(ch, fm.options)
+	logFatal(logger, err, "Failed to enable publisher confirms", FieldExchange, sendFanout)
+	fm.flow = newFlowControl(fm.options, FieldExchange, sendFanout)
+	fm.flow.watch(conn, ch)
+	fm.serverAddress = serverAddress
+	fm.conn = conn
 	fm.sendChannel = ch
 	fm.sendFanout = sendFanout
+	fm.done = make(chan struct{})
+	if fm.options.failover != nil {
+		fm.watch()
+	}
 
 	return fm
 }
 
+// watch reconnects when the connection is lost, used with WithFailover
+func (fm *SendFanoutManager) watch() {
+	notifyLost(fm.conn, func() {
+		if fm.options.reconnect(fm.done, fm.reconnect, FieldExchange, fm.sendFanout) {
+			fm.watch()
+		}
+	})
+}
+
+// reconnect replaces the connection unless the manager was closed meanwhile
+func (fm *SendFanoutManager) reconnect() error {
+	conn, err := fm.options.dial(fm.serverAddress)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = fm.options.declareExchange(ch, fm.sendFanout)
+	}
+	var p *publisher
+	if err == nil {
+		p, err = newPublisher(ch, fm.options)
+	}
+	if err != nil {
+		conn.Close()
+		return brokerError(err, nil)
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	select {
+	case <-fm.done:
+		conn.Close()
+		return nil
+	default:
+	}
+	fm.conn, fm.sendChannel, fm.publisher = conn, ch, p
+	fm.flow.watch(conn, ch)
+	return nil
+}
+
+// SendWithExpiration sends fanout message that each receiver drops if it is not consumed within ttl
+func (fm *SendFanoutManager) SendWithExpiration(msg *amqp.Publishing, ttl time.Duration) error {
+	exp, err := expiration(ttl)
+	if err != nil {
+		return err
+	}
+	withExpiration := *msg
+	withExpiration.Expiration = exp
+	return fm.Send(&withExpiration)
+}
+
 // Send fanout message
 func (fm *SendFanoutManager) Send(msg *amqp.Publishing) error {
-	log.V("Sending message on send fanout %s\n", fm.sendFanout)
-	err := fm.sendChannel.Publish(fm.sendFanout, "", false, false, *msg)
+	return fm.SendContext(context.Background(), msg)
+}
+
+// SendContext sends fanout message, waiting for the rate limit or a blocked broker until ctx is done
+func (fm *SendFanoutManager) SendContext(ctx context.Context, msg *amqp.Publishing) error {
+	logger := fm.options.logger
+	logger.Debug("Sending message on send fanout", FieldExchange, fm.sendFanout, FieldMessageID, msg.MessageId)
+	if err := fm.options.waitSend(ctx); err != nil {
+		logger.Warn("Not sending message on send fanout", FieldExchange, fm.sendFanout,
+			FieldMessageID, msg.MessageId, FieldError, err)
+		return err
+	}
+	encoded, err := fm.options.encodePublishing(msg)
+	if err == nil {
+		err = fm.flow.wait(ctx)
+	}
+	if err == nil {
+		fm.mu.RLock()
+		p := fm.publisher
+		fm.mu.RUnlock()
+		err = p.publish(ctx, fm.sendFanout, "", *encoded)
+	}
 	if err != nil {
-		fmt.Printf("Failed sending %s", err)
+		// a message whose confirm was abandoned may still be delivered with its body
+		if encoded != nil && !errors.Is(err, ErrUnconfirmed) {
+			fm.options.releaseClaim(claimKey(encoded.Headers), FieldExchange, fm.sendFanout, FieldMessageID, msg.MessageId)
+		}
+		logger.Error("Failed sending message on send fanout", FieldExchange, fm.sendFanout,
+			FieldMessageID, msg.MessageId, FieldError, err)
+	} else {
+		fm.options.wiretap.tap(encoded, fm.sendFanout, WiretapPublish)
 	}
 
 	return err
 }
+
+// Close closes the connection of the manager
+func (fm *SendFanoutManager) Close() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	close(fm.done)
+	return brokerError(fm.conn.Close(), nil)
+}
+
+// Blocked reports whether the broker currently blocks publishing
+func (fm *SendFanoutManager) Blocked() bool {
+	return fm.flow.isBlocked()
+}
@@ -1,47 +1,342 @@
 package message
 
 import (
-	"github.com/qulia/go-log/log"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/streadway/amqp"
 )
 
 // SendNamedQueueManager Deals with RabbitMqQueue connection details
 type SendNamedQueueManager struct {
 	namedQueueManager *NamedQueueManager
+	publisher         *publisher
+	flow              *flowControl
+	// connMu guards the connection and the publisher, which are replaced on reconnect
+	connMu sync.RWMutex
+
+	// mu guards the channel while spooling, offline is set when the last publish failed
+	mu      sync.Mutex
+	spool   *spool
+	offline bool
+	done    chan struct{}
+	wg      sync.WaitGroup
 }
 
 // NewSendNamedQueueManager Create new queuemanager for sending and receiving data
-func NewSendNamedQueueManager(serverAddress, queueName string) (*SendNamedQueueManager, error) {
+// With WithSpool the manager is created even if the server cannot be reached
+func NewSendNamedQueueManager(serverAddress, queueName string, opts ...Option) (*SendNamedQueueManager, error) {
 	snqm := new(SendNamedQueueManager)
-	nqm, err := NewNamedQueueManager(serverAddress, queueName)
+	nqm, err := NewNamedQueueManager(serverAddress, queueName, opts...)
+	if nqm != nil {
+		snqm.flow = newFlowControl(nqm.options, FieldQueue, queueName)
+	}
+	if nqm == nil || nqm.options.spool == nil || (err != nil && !Retryable(err)) {
+		if err == nil {
+			snqm.namedQueueManager = nqm
+			err = snqm.setupChannel()
+		}
+		if err != nil {
+			if nqm != nil {
+				nqm.Close()
+			}
+			return nil, err
+		}
+		if nqm.options.failover != nil {
+			snqm.done = make(chan struct{})
+			snqm.watch()
+		}
+		return snqm, nil
+	}
+	snqm.namedQueueManager = nqm
+	if err == nil {
+		err = snqm.setupChannel()
+	}
+	snqm.offline = err != nil
+	snqm.spool, err = openSpool(*nqm.options.spool, nqm.options, FieldQueue, queueName)
 	if err != nil {
+		nqm.Close()
 		return nil, err
 	}
-	snqm.namedQueueManager = nqm
+	snqm.done = make(chan struct{})
+	snqm.wg.Add(1)
+	go snqm.maintain()
 	return snqm, nil
 }
 
 // Send is used to send message
 func (snqm *SendNamedQueueManager) Send(msg []byte) error {
-	err := snqm.namedQueueManager.channel.Publish(
-		"",                                // exchange
-		snqm.namedQueueManager.queue.Name, // routing key
-		false,                             // mandatory
-		false,                             // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        msg,
-		})
+	return snqm.SendPublishing(&amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        msg,
+	})
+}
+
+// SendPriority sends message with a priority, the queue must be declared with WithMaxPriority
+func (snqm *SendNamedQueueManager) SendPriority(msg []byte, priority uint8) error {
+	return snqm.SendPublishing(&amqp.Publishing{
+		ContentType: "text/plain",
+		Priority:    priority,
+		Body:        msg,
+	})
+}
+
+// SendWithExpiration sends message that is dropped or dead-lettered if it is not consumed within ttl
+func (snqm *SendNamedQueueManager) SendWithExpiration(msg []byte, ttl time.Duration) error {
+	exp, err := expiration(ttl)
 	if err != nil {
-		log.E(err, "Failed sending message on queue %s with length %d\n", snqm.namedQueueManager.queue.Name, len(msg))
+		return err
+	}
+	return snqm.SendPublishing(&amqp.Publishing{
+		ContentType: "text/plain",
+		Expiration:  exp,
+		Body:        msg,
+	})
+}
+
+// SendPublishing sends the message with its properties and headers
+func (snqm *SendNamedQueueManager) SendPublishing(msg *amqp.Publishing) error {
+	return snqm.SendPublishingContext(context.Background(), msg)
+}
+
+// SendPublishingContext sends the message, waiting for the rate limit or a blocked broker until ctx is done
+// With WithSpool messages are spooled instead of waiting for a blocked broker
+func (snqm *SendNamedQueueManager) SendPublishingContext(ctx context.Context, msg *amqp.Publishing) error {
+	logger := snqm.namedQueueManager.options.logger
+	queueName := snqm.namedQueueManager.name()
+	if err := snqm.namedQueueManager.options.waitSend(ctx); err != nil {
+		logger.Warn("Not sending message", FieldQueue, queueName,
+			FieldMessageID, msg.MessageId, FieldError, err)
+		return err
+	}
+	encoded, err := snqm.namedQueueManager.options.encodePublishing(msg)
+	if err == nil {
+		if snqm.spool != nil {
+			return snqm.publishOrSpool(ctx, msg, encoded)
+		}
+		err = snqm.flow.wait(ctx)
+	}
+	if err == nil {
+		err = snqm.publish(ctx, encoded)
+	}
+	if err != nil {
+		// a message whose confirm was abandoned may still be delivered with its body
+		if encoded != nil && !errors.Is(err, ErrUnconfirmed) {
+			snqm.namedQueueManager.options.releaseClaim(claimKey(encoded.Headers),
+				FieldQueue, queueName, FieldMessageID, msg.MessageId)
+		}
+		logger.Error("Failed sending message", FieldQueue, queueName,
+			FieldMessageID, msg.MessageId, FieldLength, len(msg.Body), FieldError, err)
 	} else {
-		log.V("Sent message on queue %s with length %d\n", snqm.namedQueueManager.queue.Name, len(msg))
+		logger.Debug("Sent message", FieldQueue, queueName,
+			FieldMessageID, msg.MessageId, FieldLength, len(msg.Body))
+	}
+
+	return err
+}
+
+// setupChannel sets up publishing and flow control on the current connection
+func (snqm *SendNamedQueueManager) setupChannel() error {
+	p, err := newPublisher(snqm.namedQueueManager.channel, snqm.namedQueueManager.options)
+	if err != nil {
+		snqm.namedQueueManager.options.logger.Error("Failed to enable publisher confirms",
+			FieldQueue, snqm.namedQueueManager.name(), FieldError, err)
+		return err
+	}
+	snqm.connMu.Lock()
+	snqm.publisher = p
+	snqm.connMu.Unlock()
+	snqm.flow.watch(snqm.namedQueueManager.conn, snqm.namedQueueManager.channel)
+	return nil
+}
+
+// watch reconnects when the connection is lost, used with WithFailover when there is no spool
+func (snqm *SendNamedQueueManager) watch() {
+	nqm := snqm.namedQueueManager
+	notifyLost(nqm.conn, func() {
+		if nqm.options.reconnect(snqm.done, snqm.reconnect, FieldQueue, nqm.name()) {
+			snqm.watch()
+		}
+	})
+}
+
+// reconnect replaces the connection unless the manager was closed meanwhile
+func (snqm *SendNamedQueueManager) reconnect() error {
+	nqm := snqm.namedQueueManager
+	conn, ch, q, err := getNamedQueue(nqm.serverAddress, nqm.queueName, nqm.options)
+	if err != nil {
+		return err
+	}
+	p, err := newPublisher(ch, nqm.options)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	snqm.connMu.Lock()
+	defer snqm.connMu.Unlock()
+	select {
+	case <-snqm.done:
+		conn.Close()
+		return nil
+	default:
 	}
+	nqm.conn, nqm.channel, nqm.queue = conn, ch, q
+	snqm.publisher = p
+	snqm.flow.watch(conn, ch)
+	return nil
+}
 
+// publish sends an encoded message to the queue
+func (snqm *SendNamedQueueManager) publish(ctx context.Context, encoded *amqp.Publishing) error {
+	snqm.connMu.RLock()
+	p, queueName := snqm.publisher, snqm.namedQueueManager.queue.Name
+	snqm.connMu.RUnlock()
+	err := p.publish(ctx,
+		"",        // exchange
+		queueName, // routing key
+		*encoded)
+	if err == nil {
+		snqm.namedQueueManager.options.wiretap.tap(encoded, queueName, WiretapPublish)
+	}
 	return err
 }
 
-// Close the queue manager
+// publishOrSpool publishes directly when the connection is up and nothing is spooled,
+// otherwise the message goes to the end of the spool to keep the order
+func (snqm *SendNamedQueueManager) publishOrSpool(ctx context.Context, msg, encoded *amqp.Publishing) error {
+	o := snqm.namedQueueManager.options
+	snqm.mu.Lock()
+	defer snqm.mu.Unlock()
+	queueName := snqm.namedQueueManager.name()
+	if !snqm.offline && snqm.spool.len() == 0 && !snqm.flow.isBlocked() {
+		err := snqm.publish(ctx, encoded)
+		if errors.Is(err, ErrUnroutable) {
+			o.releaseClaim(claimKey(encoded.Headers), FieldQueue, queueName, FieldMessageID, msg.MessageId)
+			return err
+		}
+		if errors.Is(err, ErrBlocked) || errors.Is(err, ErrUnconfirmed) {
+			// ctx is done, spooling a message that may already be published would send it twice
+			return err
+		}
+		if err == nil {
+			o.logger.Debug("Sent message", FieldQueue, queueName,
+				FieldMessageID, msg.MessageId, FieldLength, len(msg.Body))
+			return nil
+		}
+		o.logger.Warn("Failed sending message, spooling", FieldQueue, queueName,
+			FieldMessageID, msg.MessageId, FieldError, err)
+		snqm.offline = true
+	}
+	if err := snqm.spool.append(encoded); err != nil {
+		o.releaseClaim(claimKey(encoded.Headers), FieldQueue, queueName, FieldMessageID, msg.MessageId)
+		o.logger.Error("Failed spooling message", FieldQueue, queueName,
+			FieldMessageID, msg.MessageId, FieldLength, len(msg.Body), FieldError, err)
+		return err
+	}
+	o.logger.Debug("Spooled message", FieldQueue, queueName,
+		FieldMessageID, msg.MessageId, FieldLength, len(msg.Body))
+	return nil
+}
+
+// maintain reconnects and flushes the spool every RetryInterval and syncs it with SpoolSyncInterval
+func (snqm *SendNamedQueueManager) maintain() {
+	defer snqm.wg.Done()
+	config := snqm.spool.config
+	retry := time.NewTicker(config.RetryInterval)
+	defer retry.Stop()
+	var syncTick <-chan time.Time
+	if config.Sync == SpoolSyncInterval {
+		ticker := time.NewTicker(config.SyncInterval)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	for {
+		select {
+		case <-snqm.done:
+			return
+		case <-syncTick:
+			if err := snqm.spool.sync(); err != nil {
+				snqm.namedQueueManager.options.logger.Error("Failed syncing spool",
+					FieldQueue, snqm.namedQueueManager.name(), FieldError, err)
+			}
+		case <-retry.C:
+			snqm.flush()
+		}
+	}
+}
+
+// flush reconnects if the last publish failed and publishes the spooled messages
+func (snqm *SendNamedQueueManager) flush() {
+	snqm.mu.Lock()
+	defer snqm.mu.Unlock()
+	nqm := snqm.namedQueueManager
+	if !snqm.offline && snqm.spool.len() == 0 {
+		return
+	}
+	if snqm.offline {
+		if err := nqm.connect(); err != nil {
+			return
+		}
+		if err := snqm.setupChannel(); err != nil {
+			return
+		}
+		snqm.offline = false
+		nqm.options.logger.Info("Reconnected, flushing spool", FieldQueue, nqm.name(), FieldCount, snqm.spool.len())
+	}
+	if snqm.flow.isBlocked() {
+		return
+	}
+	// an unroutable message is logged and counted by the publisher, retrying does not help
+	publish := func(encoded *amqp.Publishing) error {
+		if err := snqm.publish(context.Background(), encoded); !errors.Is(err, ErrUnroutable) {
+			return err
+		}
+		return nil
+	}
+	if err := snqm.spool.flush(publish); err != nil {
+		snqm.offline = true
+		nqm.options.logger.Warn("Failed flushing spool", FieldQueue, nqm.name(), FieldError, err)
+	}
+}
+
+// Blocked reports whether the broker currently blocks publishing
+func (snqm *SendNamedQueueManager) Blocked() bool {
+	return snqm.flow.isBlocked()
+}
+
+// SpoolDepth returns the number of messages waiting in the spool, 0 without WithSpool
+func (snqm *SendNamedQueueManager) SpoolDepth() int {
+	if snqm.spool == nil {
+		return 0
+	}
+	return snqm.spool.len()
+}
+
+// Close the queue manager, spooled messages stay on disk for the next run
+// The spool is flushed one last time only while connected, Close does not wait for the broker
 func (snqm *SendNamedQueueManager) Close() error {
+	if snqm.spool != nil {
+		close(snqm.done)
+		snqm.wg.Wait()
+		snqm.mu.Lock()
+		offline := snqm.offline
+		snqm.mu.Unlock()
+		if offline {
+			snqm.namedQueueManager.options.logger.Info("Closing while disconnected, leaving the spool on disk",
+				FieldQueue, snqm.namedQueueManager.name(), FieldCount, snqm.spool.len())
+		} else {
+			snqm.flush()
+		}
+		if err := snqm.spool.close(); err != nil {
+			snqm.namedQueueManager.options.logger.Error("Failed closing spool",
+				FieldQueue, snqm.namedQueueManager.name(), FieldError, err)
+		}
+	} else if snqm.done != nil {
+		snqm.connMu.Lock()
+		defer snqm.connMu.Unlock()
+		close(snqm.done)
+	}
 	return snqm.namedQueueManager.Close()
 }
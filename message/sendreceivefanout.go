@@ -1,7 +1,8 @@
 package message
 
 import (
-	"github.com/qulia/go-log/log"
+	"context"
+
 	"github.com/streadway/amqp"
 )
 
@@ -14,19 +15,19 @@ type SendReceiveFanoutManager struct {
 
 //NewSendReceiveFanoutManager creates new manager
 func NewSendReceiveFanoutManager(serverAddress, receiveFanout, sendFanout string,
-	onReceive func(*amqp.Delivery) *amqp.Publishing) *SendReceiveFanoutManager {
+	onReceive func(*amqp.Delivery) *amqp.Publishing, opts ...Option) *SendReceiveFanoutManager {
 
 	fm := new(SendReceiveFanoutManager)
 	fm.onReceive = onReceive
+	fm.sendFanoutManager = NewSendFanoutManager(serverAddress, sendFanout, opts...)
 	fm.receiveFanoutManager = NewReceiveFanoutManager(
 		serverAddress, receiveFanout, func(msg *amqp.Delivery) {
 			outgoing := onReceive(msg)
 			if outgoing != nil {
-				err := fm.sendFanoutManager.Send(outgoing)
-				log.E(err, "Failed to send message %s\n", sendFanout)
+				// Send logs the failure with the exchange and message details
+				_ = fm.sendFanoutManager.Send(outgoing)
 			}
-		})
-	fm.sendFanoutManager = NewSendFanoutManager(serverAddress, sendFanout)
+		}, opts...)
 
 	return fm
 }
@@ -35,3 +36,13 @@ func NewSendReceiveFanoutManager(serverAddress, receiveFanout, sendFanout string
 func (fm *SendReceiveFanoutManager) Send(msg *amqp.Publishing) error {
 	return fm.sendFanoutManager.Send(msg)
 }
+
+// SendContext sends fanout message, waiting for the rate limit or a blocked broker until ctx is done
+func (fm *SendReceiveFanoutManager) SendContext(ctx context.Context, msg *amqp.Publishing) error {
+	return fm.sendFanoutManager.SendContext(ctx, msg)
+}
+
+// Blocked reports whether the broker currently blocks publishing
+func (fm *SendReceiveFanoutManager) Blocked() bool {
+	return fm.sendFanoutManager.Blocked()
+}
@@ -0,0 +1,238 @@
+package message
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers set on signed messages
+const (
+	// SignatureHeader holds the signature of the body and the signed properties
+	SignatureHeader = "x-signature"
+	// SignatureAlgorithmHeader holds the algorithm, one of the Signature constants
+	SignatureAlgorithmHeader = "x-signature-algorithm"
+)
+
+// Signature algorithms
+const (
+	SignatureHMACSHA256 = "hmac-sha256"
+	SignatureEd25519    = "ed25519"
+)
+
+// SignedProperty names a message property covered by the signature
+type SignedProperty string
+
+// Properties that can be signed along with the body
+const (
+	PropertyContentType     SignedProperty = "content-type"
+	PropertyContentEncoding SignedProperty = "content-encoding"
+	PropertyCorrelationID   SignedProperty = "correlation-id"
+	PropertyReplyTo         SignedProperty = "reply-to"
+	PropertyMessageID       SignedProperty = "message-id"
+	PropertyTimestamp       SignedProperty = "timestamp"
+	PropertyType            SignedProperty = "type"
+	PropertyUserID          SignedProperty = "user-id"
+	PropertyAppID           SignedProperty = "app-id"
+)
+
+// ErrInvalidSignature is wrapped by all verification failures, including a claimed body that
+// does not match its signed digest
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Signer signs outgoing messages
+type Signer interface {
+	Algorithm() string
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier checks the signature of incoming messages
+type Verifier interface {
+	Verify(algorithm string, data, signature []byte) error
+}
+
+// NewHMACSigner signs with HMAC-SHA256, receivers need a verifier with the same key
+func NewHMACSigner(key []byte) Signer {
+	return hmacKey(key)
+}
+
+// NewHMACVerifier verifies HMAC-SHA256 signatures
+func NewHMACVerifier(key []byte) Verifier {
+	return hmacKey(key)
+}
+
+// NewEd25519Signer signs with the private key, receivers only need the public key
+func NewEd25519Signer(key ed25519.PrivateKey) Signer {
+	return ed25519Signer(key)
+}
+
+// NewEd25519Verifier verifies Ed25519 signatures with the public key
+func NewEd25519Verifier(key ed25519.PublicKey) Verifier {
+	return ed25519Verifier(key)
+}
+
+// WithSigning signs the body and the properties of every message sent
+// Receivers must be configured with WithVerification for the same properties
+func WithSigning(signer Signer, properties ...SignedProperty) Option {
+	return func(o *options) {
+		o.signer = signer
+		o.signProperties = properties
+	}
+}
+
+// WithVerification verifies the signature of every message received before the handler is called
+// Unsigned or tampered messages are rejected without requeue and counted as MetricSignatureRejected,
+// use WithDeadLetterExchange to quarantine them, for fanout receivers together with WithFanoutAck
+func WithVerification(verifier Verifier, properties ...SignedProperty) Option {
+	return func(o *options) {
+		o.verifier = verifier
+		o.verifyProperties = properties
+	}
+}
+
+// sign adds the signature headers to msg, headers are copied before they are changed
+func (o *options) sign(msg *amqp.Publishing) error {
+	if o.signer == nil {
+		return nil
+	}
+	data, err := signedData(o.signProperties, msg, msg.Body)
+	if err != nil {
+		return err
+	}
+	signature, err := o.signer.Sign(data)
+	if err != nil {
+		return err
+	}
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[SignatureHeader] = signature
+	headers[SignatureAlgorithmHeader] = o.signer.Algorithm()
+	msg.Headers = headers
+	return nil
+}
+
+// verify checks and removes the signature headers of d
+func (o *options) verify(d *amqp.Delivery) error {
+	if o.verifier == nil {
+		return nil
+	}
+	signature, ok := d.Headers[SignatureHeader].([]byte)
+	if !ok {
+		return fmt.Errorf("%w: message is not signed", ErrInvalidSignature)
+	}
+	algorithm, _ := d.Headers[SignatureAlgorithmHeader].(string)
+	data, err := signedData(o.verifyProperties, &amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+	}, d.Body)
+	if err != nil {
+		return err
+	}
+	if err := o.verifier.Verify(algorithm, data, signature); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err)
+	}
+	delete(d.Headers, SignatureHeader)
+	delete(d.Headers, SignatureAlgorithmHeader)
+	return nil
+}
+
+// signedData is the canonical form of the properties followed by the body
+// The claim check key and digest are always signed since the body is empty when they are used
+func signedData(properties []SignedProperty, msg *amqp.Publishing, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if key := claimKey(msg.Headers); key != "" {
+		digest, _ := msg.Headers[ClaimDigestHeader].([]byte)
+		fmt.Fprintf(&buf, "%s:%d:%s\n", ClaimCheckHeader, len(key), key)
+		fmt.Fprintf(&buf, "%s:%d:%x\n", ClaimDigestHeader, 2*len(digest), digest)
+	}
+	for _, p := range properties {
+		var value string
+		switch p {
+		case PropertyContentType:
+			value = msg.ContentType
+		case PropertyContentEncoding:
+			value = msg.ContentEncoding
+		case PropertyCorrelationID:
+			value = msg.CorrelationId
+		case PropertyReplyTo:
+			value = msg.ReplyTo
+		case PropertyMessageID:
+			value = msg.MessageId
+		case PropertyTimestamp:
+			value = strconv.FormatInt(msg.Timestamp.Unix(), 10)
+		case PropertyType:
+			value = msg.Type
+		case PropertyUserID:
+			value = msg.UserId
+		case PropertyAppID:
+			value = msg.AppId
+		default:
+			return nil, fmt.Errorf("unknown signed property %q", p)
+		}
+		// length prefixes keep the boundaries unambiguous
+		fmt.Fprintf(&buf, "%s:%d:%s\n", p, len(value), value)
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+type hmacKey []byte
+
+func (k hmacKey) Algorithm() string {
+	return SignatureHMACSHA256
+}
+
+func (k hmacKey) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+func (k hmacKey) Verify(algorithm string, data, signature []byte) error {
+	if algorithm != SignatureHMACSHA256 {
+		return fmt.Errorf("unexpected algorithm %q", algorithm)
+	}
+	expected, _ := k.Sign(data)
+	if !hmac.Equal(expected, signature) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+type ed25519Signer ed25519.PrivateKey
+
+func (k ed25519Signer) Algorithm() string {
+	return SignatureEd25519
+}
+
+func (k ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), data), nil
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (k ed25519Verifier) Verify(algorithm string, data, signature []byte) error {
+	if algorithm != SignatureEd25519 {
+		return fmt.Errorf("unexpected algorithm %q", algorithm)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(k), data, signature) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package message
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+type countingMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{counters: map[string]int64{}, gauges: map[string]int64{}}
+}
+
+func (m *countingMetrics) Add(name string, delta int64, keyvals ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *countingMetrics) Set(name string, value int64, keyvals ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func TestSigningHMAC(t *testing.T) {
+	key := []byte("shared secret")
+	sender := newOptions([]Option{WithSigning(NewHMACSigner(key), PropertyMessageID, PropertyType)})
+	metrics := newCountingMetrics()
+	receiver := newOptions([]Option{
+		WithVerification(NewHMACVerifier(key), PropertyMessageID, PropertyType),
+		WithMetrics(metrics),
+	})
+
+	signed, err := sender.encodePublishing(&amqp.Publishing{MessageId: "m1", Type: "created", Body: []byte("event")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := func() *amqp.Delivery {
+		headers := amqp.Table{}
+		for k, v := range signed.Headers {
+			headers[k] = v
+		}
+		return &amqp.Delivery{MessageId: signed.MessageId, Type: signed.Type, Headers: headers, Body: signed.Body}
+	}
+
+	d := delivery()
+	if err := receiver.decodeDelivery(d); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Headers[SignatureHeader]; ok {
+		t.Error("signature header was not removed")
+	}
+
+	tamperedProperty := delivery()
+	tamperedProperty.Type = "deleted"
+	tamperedBody := delivery()
+	tamperedBody.Body = []byte("evil")
+	unsigned := &amqp.Delivery{MessageId: "m1", Body: []byte("event")}
+	for _, d := range []*amqp.Delivery{tamperedProperty, tamperedBody, unsigned} {
+		if err := receiver.decodeDelivery(d); err == nil {
+			t.Errorf("expected %+v to be rejected", d)
+		}
+	}
+	if metrics.counters[MetricSignatureRejected] != 3 {
+		t.Errorf("expected 3 rejections, got %d", metrics.counters[MetricSignatureRejected])
+	}
+}
+
+func TestSigningSharedOptions(t *testing.T) {
+	// the send/receive fanout manager gives the same options to its sender and receiver
+	key := []byte("shared secret")
+	o := newOptions([]Option{
+		WithSigning(NewHMACSigner(key), PropertyMessageID),
+		WithVerification(NewHMACVerifier(key), PropertyType),
+	})
+	signed, err := o.encodePublishing(&amqp.Publishing{MessageId: "m1", Type: "created", Body: []byte("event")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := &amqp.Delivery{MessageId: "m2", Type: "created", Headers: signed.Headers, Body: signed.Body}
+	verifier := newOptions([]Option{WithVerification(NewHMACVerifier(key), PropertyMessageID)})
+	if err := verifier.decodeDelivery(tampered); err == nil {
+		t.Fatal("expected the signature to cover the message id")
+	}
+	if fmt.Sprint(o.signProperties, o.verifyProperties) != "[message-id] [type]" {
+		t.Fatalf("unexpected properties %v %v", o.signProperties, o.verifyProperties)
+	}
+}
+
+func TestSigningEd25519(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := newOptions([]Option{WithSigning(NewEd25519Signer(private))})
+	receiver := newOptions([]Option{WithVerification(NewEd25519Verifier(public))})
+	signed, err := sender.encodePublishing(&amqp.Publishing{Body: []byte("event")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.decodeDelivery(deliveryOf(signed)); err != nil {
+		t.Error(err)
+	}
+
+	hmacReceiver := newOptions([]Option{WithVerification(NewHMACVerifier([]byte("key")))})
+	signed, _ = sender.encodePublishing(&amqp.Publishing{Body: []byte("event")})
+	if err := hmacReceiver.decodeDelivery(deliveryOf(signed)); err == nil {
+		t.Error("expected algorithm mismatch to be rejected")
+	}
+}
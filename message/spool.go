@@ -0,0 +1,296 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrSpoolFull is returned by Send when the broker is unavailable and the spool reached its size limit
+var ErrSpoolFull = errors.New("spool is full")
+
+// SpoolSync is how often the spool file is synced to disk
+type SpoolSync int
+
+const (
+	// SpoolSyncAlways syncs after every message, nothing acknowledged by Send is lost on a crash
+	SpoolSyncAlways SpoolSync = iota
+	// SpoolSyncInterval syncs every SyncInterval, a crash can lose the messages of the last interval
+	SpoolSyncInterval
+	// SpoolSyncNever leaves syncing to the operating system
+	SpoolSyncNever
+)
+
+const (
+	spoolFileName       = "spool.wal"
+	spoolOffsetFileName = "spool.offset"
+	// spoolFrameHeader is the record length and CRC-32 before every record
+	spoolFrameHeader = 8
+
+	defaultSpoolRetryInterval = 5 * time.Second
+	defaultSpoolSyncInterval  = time.Second
+)
+
+// SpoolConfig configures the local disk spool of a sender
+type SpoolConfig struct {
+	// Dir holds the spool files, one directory per sender
+	Dir string
+	// MaxBytes limits the spool file size, 0 means no limit
+	MaxBytes int64
+	// Sync is the fsync policy
+	Sync SpoolSync
+	// SyncInterval is used with SpoolSyncInterval, defaults to one second
+	SyncInterval time.Duration
+	// RetryInterval is how often the sender reconnects and flushes the spool, defaults to 5 seconds
+	RetryInterval time.Duration
+}
+
+// WithSpool appends messages to a local write-ahead file while the broker is unavailable
+// and publishes them in order once the connection is back, Send succeeds once the message
+// is spooled. A crash while flushing can publish the last message twice
+// The spool depth is reported as MetricSpoolDepth and MetricSpoolBytes
+func WithSpool(config SpoolConfig) Option {
+	return func(o *options) {
+		if config.Dir == "" {
+			o.setErr(errors.New("spool needs a directory"))
+			return
+		}
+		if config.SyncInterval <= 0 {
+			config.SyncInterval = defaultSpoolSyncInterval
+		}
+		if config.RetryInterval <= 0 {
+			config.RetryInterval = defaultSpoolRetryInterval
+		}
+		o.spool = &config
+	}
+}
+
+// spool is an append only file of encoded messages, offset is where the next flush starts
+// Once everything is flushed the file is truncated
+type spool struct {
+	mu         sync.Mutex
+	config     SpoolConfig
+	file       *os.File
+	offsetFile *os.File
+	size       int64
+	offset     int64
+	depth      int
+	dirty      bool
+	options    *options
+	keyvals    []interface{}
+}
+
+// openSpool opens the spool and counts the messages left by a previous run
+// A partly written last record is truncated
+func openSpool(config SpoolConfig, o *options, keyvals ...interface{}) (*spool, error) {
+	if err := os.MkdirAll(config.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(config.Dir, spoolFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	offsetFile, err := os.OpenFile(filepath.Join(config.Dir, spoolOffsetFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &spool{config: config, file: file, offsetFile: offsetFile, options: o, keyvals: keyvals}
+	if err := s.recover(); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.report()
+	return s, nil
+}
+
+func (s *spool) recover() error {
+	var buf [8]byte
+	n, err := s.offsetFile.ReadAt(buf[:], 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if n == len(buf) {
+		s.offset = int64(binary.BigEndian.Uint64(buf[:]))
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if s.offset > info.Size() {
+		// a crash after the drained spool was truncated and before the offset was reset
+		s.options.logger.Warn("Resetting spool offset past the end of the spool", s.keyvals...)
+		s.offset = 0
+		if err := s.saveOffset(); err != nil {
+			return err
+		}
+		if err := s.offsetFile.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size = s.offset
+	for {
+		_, next, err := s.read(s.size)
+		if err != nil {
+			break
+		}
+		s.size = next
+		s.depth++
+	}
+	if s.size < info.Size() {
+		s.options.logger.Warn("Truncating partly written spool record", s.keyvals...)
+		if err := s.file.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes the message to the end of the spool
+func (s *spool) append(msg *amqp.Publishing) error {
+	data, err := marshalRecord(publishingRecord(msg))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frameSize := int64(spoolFrameHeader + len(data))
+	if s.config.MaxBytes > 0 && s.size+frameSize > s.config.MaxBytes {
+		return ErrSpoolFull
+	}
+	frame := make([]byte, frameSize)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[spoolFrameHeader:], data)
+	if _, err := s.file.WriteAt(frame, s.size); err != nil {
+		return err
+	}
+	s.size += frameSize
+	s.depth++
+	s.dirty = true
+	if s.config.Sync == SpoolSyncAlways {
+		if err := s.syncLocked(); err != nil {
+			return err
+		}
+	}
+	s.report()
+	return nil
+}
+
+// flush publishes the spooled messages in order until publish fails
+func (s *spool) flush(publish func(*amqp.Publishing) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.offset < s.size {
+		r, next, err := s.read(s.offset)
+		if err != nil {
+			return err
+		}
+		if err := publish(r.Publishing()); err != nil {
+			return err
+		}
+		s.offset = next
+		s.depth--
+		if err := s.saveOffset(); err != nil {
+			return err
+		}
+		s.report()
+	}
+	if s.size == 0 {
+		return nil
+	}
+	// everything is published, start over with an empty file
+	// recover resets the offset if a crash hits before it is saved
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.size, s.offset = 0, 0
+	err := s.saveOffset()
+	s.report()
+	return err
+}
+
+// read returns the record at offset and the offset of the next record
+func (s *spool) read(offset int64) (*Record, int64, error) {
+	var header [spoolFrameHeader]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	data := make([]byte, length)
+	if _, err := s.file.ReadAt(data, offset+spoolFrameHeader); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("spool record checksum mismatch")
+	}
+	r, err := unmarshalRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, offset + spoolFrameHeader + int64(length), nil
+}
+
+func (s *spool) saveOffset() error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(s.offset))
+	if _, err := s.offsetFile.WriteAt(buf[:], 0); err != nil {
+		return err
+	}
+	if s.config.Sync == SpoolSyncAlways {
+		return s.offsetFile.Sync()
+	}
+	s.dirty = true
+	return nil
+}
+
+// sync is called every SyncInterval with SpoolSyncInterval
+func (s *spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncLocked()
+}
+
+func (s *spool) syncLocked() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return s.offsetFile.Sync()
+}
+
+// len returns the number of messages waiting to be flushed
+func (s *spool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+func (s *spool) report() {
+	s.options.metrics.Set(MetricSpoolDepth, int64(s.depth), s.keyvals...)
+	s.options.metrics.Set(MetricSpoolBytes, s.size-s.offset, s.keyvals...)
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.syncLocked()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := s.offsetFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func openTestSpool(t *testing.T, config SpoolConfig) *spool {
+	t.Helper()
+	s, err := openSpool(config, newOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSpoolFlushInOrder(t *testing.T) {
+	s := openTestSpool(t, SpoolConfig{Dir: t.TempDir()})
+	defer s.close()
+	for i := 0; i < 5; i++ {
+		msg := &amqp.Publishing{MessageId: fmt.Sprint(i), Headers: amqp.Table{"n": int32(i)}, Body: []byte{byte(i)}}
+		if err := s.append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the broker goes away after two messages
+	var sent []string
+	failAfter := 2
+	publish := func(p *amqp.Publishing) error {
+		if len(sent) == failAfter {
+			return errors.New("connection closed")
+		}
+		sent = append(sent, p.MessageId)
+		return nil
+	}
+	if err := s.flush(publish); err == nil {
+		t.Fatal("expected flush to stop on the publish error")
+	}
+	if s.len() != 3 {
+		t.Fatalf("expected 3 spooled messages, got %d", s.len())
+	}
+
+	failAfter = -1
+	if err := s.flush(publish); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[0 1 2 3 4]" {
+		t.Fatalf("unexpected order %v", sent)
+	}
+	if s.len() != 0 || s.size != 0 {
+		t.Fatalf("expected empty spool, got %d messages, %d bytes", s.len(), s.size)
+	}
+}
+
+func TestSpoolRecover(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, SpoolConfig{Dir: dir})
+	for i := 0; i < 3; i++ {
+		if err := s.append(&amqp.Publishing{MessageId: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := true
+	s.flush(func(p *amqp.Publishing) error {
+		if first {
+			first = false
+			return nil
+		}
+		return errors.New("connection closed")
+	})
+	s.close()
+
+	// simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(filepath.Join(dir, spoolFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	s = openTestSpool(t, SpoolConfig{Dir: dir})
+	defer s.close()
+	if s.len() != 2 {
+		t.Fatalf("expected 2 spooled messages after recovery, got %d", s.len())
+	}
+	var sent []string
+	if err := s.flush(func(p *amqp.Publishing) error {
+		sent = append(sent, p.MessageId)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(sent) != "[1 2]" {
+		t.Fatalf("unexpected messages after recovery %v", sent)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	s := openTestSpool(t, SpoolConfig{Dir: t.TempDir(), MaxBytes: 200})
+	defer s.close()
+	body := make([]byte, 64)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		err = s.append(&amqp.Publishing{Body: body})
+	}
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("expected ErrSpoolFull, got %v", err)
+	}
+	if s.size > 200 {
+		t.Fatalf("spool grew past the limit to %d bytes", s.size)
+	}
+}
+
+func TestWithSpoolNeedsDir(t *testing.T) {
+	if o := newOptions([]Option{WithSpool(SpoolConfig{})}); o.err == nil {
+		t.Fatal("expected an error without a directory")
+	}
+}
+
+func TestSpoolCrashAfterTruncate(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, SpoolConfig{Dir: dir})
+	for i := 0; i < 2; i++ {
+		if err := s.append(&amqp.Publishing{MessageId: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// everything was published and the spool truncated, the crash hit before the offset was reset
+	s.offset = s.size
+	if err := s.saveOffset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.file.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	s = openTestSpool(t, SpoolConfig{Dir: dir})
+	if s.len() != 0 || s.offset != 0 {
+		t.Fatalf("expected an empty spool, got %d messages at offset %d", s.len(), s.offset)
+	}
+	if err := s.append(&amqp.Publishing{MessageId: "next"}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// the reset offset was saved
+	s = openTestSpool(t, SpoolConfig{Dir: dir})
+	defer s.close()
+	if s.len() != 1 {
+		t.Fatalf("expected the new message after reopening, got %d messages", s.len())
+	}
+}
+
+func TestSpoolIntervalSyncsOffset(t *testing.T) {
+	s := openTestSpool(t, SpoolConfig{Dir: t.TempDir(), Sync: SpoolSyncInterval})
+	defer s.close()
+	s.dirty = false
+	if err := s.saveOffset(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.dirty {
+		t.Fatal("expected the saved offset to be synced on the next interval")
+	}
+}
+
+func TestSpoolCloseWhileDisconnected(t *testing.T) {
+	dir := t.TempDir()
+	dials := 0
+	snqm, err := NewSendNamedQueueManager("amqp://127.0.0.1:1/", "spooled",
+		WithLogger(NopLogger()), WithSpool(SpoolConfig{Dir: dir, RetryInterval: time.Hour}),
+		WithDialConfig(amqp.Config{Dial: func(network, addr string) (net.Conn, error) {
+			dials++
+			return nil, errors.New("unreachable")
+		}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snqm.Send([]byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	dialed := dials
+	if err := snqm.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if dials != dialed {
+		t.Errorf("expected Close not to reconnect, dialed %d more times", dials-dialed)
+	}
+	s := openTestSpool(t, SpoolConfig{Dir: dir})
+	defer s.close()
+	if s.len() != 1 {
+		t.Fatalf("expected the message to stay spooled, got %d", s.len())
+	}
+}
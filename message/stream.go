@@ -0,0 +1,211 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// streamOffsetHeader is set by RabbitMQ on every delivery from a stream
+const streamOffsetHeader = "x-stream-offset"
+
+// defaultStreamPrefetch is used for streams when WithPrefetch is not set, streams require one
+const defaultStreamPrefetch = 100
+
+// StreamOffset is where a stream consumer starts reading
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	// StreamFirst starts at the first message still in the stream
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts at the last chunk written to the stream
+	StreamLast = StreamOffset{"last"}
+	// StreamNext starts with the next message written to the stream, the default
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamAt starts at the message with the offset
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// StreamFrom starts at the first chunk written at or after t
+func StreamFrom(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+func (so StreamOffset) String() string {
+	return fmt.Sprint(so.value)
+}
+
+// WithStreamOffset sets where the receiver starts reading a stream queue
+// An offset saved in the OffsetStore takes precedence
+func WithStreamOffset(offset StreamOffset) Option {
+	return func(o *options) {
+		if offset.value == nil {
+			o.setErr(errors.New("empty stream offset"))
+			return
+		}
+		o.streamOffset = offset
+	}
+}
+
+// OffsetStore persists how far a stream consumer has read
+type OffsetStore interface {
+	// Load returns the saved offset of the consumer, false if there is none
+	Load(consumer string) (int64, bool, error)
+	// Save stores the offset the consumer continues from
+	Save(consumer string, offset int64) error
+}
+
+// WithOffsetStore saves the offset of a stream receiver after its deliveries are settled
+// so a restarted receiver with the same consumer name continues where it stopped
+func WithOffsetStore(store OffsetStore, consumer string) Option {
+	return func(o *options) {
+		if consumer == "" {
+			o.setErr(errors.New("offset store needs a consumer name"))
+			return
+		}
+		o.offsetStore = store
+		o.offsetConsumer = consumer
+	}
+}
+
+// FileOffsetStore keeps one file per consumer in a directory
+type FileOffsetStore struct {
+	dir string
+}
+
+// NewFileOffsetStore creates the directory if it does not exist
+func NewFileOffsetStore(dir string) (*FileOffsetStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileOffsetStore{dir: dir}, nil
+}
+
+// Load implements OffsetStore
+func (fs *FileOffsetStore) Load(consumer string) (int64, bool, error) {
+	data, err := os.ReadFile(filepath.Join(fs.dir, consumer+".offset"))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid offset file for %s: %w", consumer, err)
+	}
+	return offset, true, nil
+}
+
+// Save implements OffsetStore, the file is replaced atomically
+func (fs *FileOffsetStore) Save(consumer string, offset int64) error {
+	path := filepath.Join(fs.dir, consumer+".offset")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// streamTracker follows the offsets of deliveries being handled so the saved offset never
+// skips a delivery that is still in flight
+type streamTracker struct {
+	mu       sync.Mutex
+	inFlight map[int64]struct{}
+	next     int64
+	saved    int64
+	options  *options
+}
+
+func newStreamTracker(o *options, next int64) *streamTracker {
+	return &streamTracker{
+		inFlight: map[int64]struct{}{},
+		next:     next,
+		saved:    next,
+		options:  o,
+	}
+}
+
+// streamOffsetOf returns the stream offset of the delivery, false if it is not from a stream
+func streamOffsetOf(d *amqp.Delivery) (int64, bool) {
+	offset, ok := d.Headers[streamOffsetHeader].(int64)
+	return offset, ok
+}
+
+// delivered records a delivery before it is handled
+func (st *streamTracker) delivered(d *amqp.Delivery) {
+	offset, ok := streamOffsetOf(d)
+	if st == nil || !ok {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.inFlight[offset] = struct{}{}
+}
+
+// settled records the delivery with the offset is acked or nacked and saves the offset if it moved
+func (st *streamTracker) settled(offset int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.inFlight, offset)
+	if offset >= st.next {
+		st.next = offset + 1
+	}
+	next := st.next
+	for o := range st.inFlight {
+		if o < next {
+			next = o
+		}
+	}
+	if next <= st.saved || st.options.offsetStore == nil {
+		return
+	}
+	if err := st.options.offsetStore.Save(st.options.offsetConsumer, next); err != nil {
+		st.options.logger.Warn("Failed to save stream offset", FieldError, err)
+		return
+	}
+	st.saved = next
+}
+
+// startStream starts tracking and returns the offset to consume from, the saved offset if there is one
+func (rnqm *ReceiveNamedQueueManager) startStream() (StreamOffset, error) {
+	o := rnqm.namedQueueManager.options
+	offset := o.streamOffset
+	var next int64
+	if o.offsetStore != nil {
+		saved, ok, err := o.offsetStore.Load(o.offsetConsumer)
+		if err != nil {
+			o.logger.Error("Failed to load stream offset", FieldQueue, rnqm.namedQueueManager.queue.Name, FieldError, err)
+			return StreamOffset{}, err
+		}
+		if ok {
+			next = saved
+			offset = StreamAt(saved)
+		}
+	}
+	rnqm.stream = newStreamTracker(o, next)
+	return offset, nil
+}
+
+// Offset returns the offset the receiver continues from, false if it is not a stream receiver
+func (rnqm *ReceiveNamedQueueManager) Offset() (int64, bool) {
+	st := rnqm.stream
+	if st == nil {
+		return 0, false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.next, true
+}
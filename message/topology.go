@@ -0,0 +1,446 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/streadway/amqp"
+	"gopkg.in/yaml.v3"
+)
+
+// Topology describes exchanges, queues and bindings, it is loaded from YAML or JSON
+//
+//	strict: true
+//	exchanges:
+//	  - name: orders
+//	    kind: topic
+//	    durable: true
+//	queues:
+//	  - name: orders.created
+//	    durable: true
+//	    arguments:
+//	      x-queue-type: quorum
+//	bindings:
+//	  - queue: orders.created
+//	    exchange: orders
+//	    key: created.#
+//
+// Unknown keys are rejected. Policies cannot be declared over AMQP, a policies section fails
+// to parse, set them with rabbitmqctl or the management API
+type Topology struct {
+	// Strict makes Apply fail when an exchange or queue exists with other settings
+	Strict    bool           `json:"strict" yaml:"strict"`
+	Exchanges []ExchangeSpec `json:"exchanges" yaml:"exchanges"`
+	Queues    []QueueSpec    `json:"queues" yaml:"queues"`
+	Bindings  []BindingSpec  `json:"bindings" yaml:"bindings"`
+}
+
+// ExchangeSpec is an exchange of the topology
+type ExchangeSpec struct {
+	Name       string                 `json:"name" yaml:"name"`
+	Kind       string                 `json:"kind" yaml:"kind"`
+	Durable    bool                   `json:"durable" yaml:"durable"`
+	AutoDelete bool                   `json:"auto_delete" yaml:"auto_delete"`
+	Internal   bool                   `json:"internal" yaml:"internal"`
+	Arguments  map[string]interface{} `json:"arguments" yaml:"arguments"`
+}
+
+// QueueSpec is a queue of the topology
+type QueueSpec struct {
+	Name       string                 `json:"name" yaml:"name"`
+	Durable    bool                   `json:"durable" yaml:"durable"`
+	AutoDelete bool                   `json:"auto_delete" yaml:"auto_delete"`
+	Exclusive  bool                   `json:"exclusive" yaml:"exclusive"`
+	Arguments  map[string]interface{} `json:"arguments" yaml:"arguments"`
+}
+
+// BindingSpec binds a queue to an exchange
+type BindingSpec struct {
+	Queue     string                 `json:"queue" yaml:"queue"`
+	Exchange  string                 `json:"exchange" yaml:"exchange"`
+	Key       string                 `json:"key" yaml:"key"`
+	Arguments map[string]interface{} `json:"arguments" yaml:"arguments"`
+}
+
+// TopologyChangeKind is what Apply does or would do to an entity
+type TopologyChangeKind string
+
+const (
+	// TopologyCreate is an exchange or queue that does not exist yet
+	TopologyCreate TopologyChangeKind = "create"
+	// TopologyMismatch is an exchange or queue that exists with other settings, Apply leaves it as it is
+	TopologyMismatch TopologyChangeKind = "mismatch"
+	// TopologyBind is a binding, the broker cannot tell whether a binding exists so it is always declared
+	TopologyBind TopologyChangeKind = "bind"
+)
+
+// TopologyChange is one difference between the topology and the broker
+type TopologyChange struct {
+	Kind TopologyChangeKind
+	// Entity is "exchange", "queue" or "binding"
+	Entity string
+	Name   string
+	// Detail is the broker's error for a mismatch
+	Detail string
+}
+
+func (c TopologyChange) String() string {
+	if c.Detail != "" {
+		return fmt.Sprintf("%s %s %s: %s", c.Kind, c.Entity, c.Name, c.Detail)
+	}
+	return fmt.Sprintf("%s %s %s", c.Kind, c.Entity, c.Name)
+}
+
+// LoadTopology reads the topology from a .yaml, .yml or .json file
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseTopologyJSON(data)
+	case ".yaml", ".yml":
+		return ParseTopologyYAML(data)
+	}
+	return nil, fmt.Errorf("unknown topology file type %s", path)
+}
+
+// ParseTopologyJSON parses a JSON topology
+func ParseTopologyJSON(data []byte) (*Topology, error) {
+	if err := rejectPolicies(func(v interface{}) error { return json.Unmarshal(data, v) }); err != nil {
+		return nil, err
+	}
+	t := new(Topology)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(t); err != nil {
+		return nil, err
+	}
+	return t, t.validate()
+}
+
+// ParseTopologyYAML parses a YAML topology
+func ParseTopologyYAML(data []byte) (*Topology, error) {
+	if err := rejectPolicies(func(v interface{}) error { return yaml.Unmarshal(data, v) }); err != nil {
+		return nil, err
+	}
+	t := new(Topology)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(t); err != nil {
+		return nil, err
+	}
+	return t, t.validate()
+}
+
+// rejectPolicies explains why a policies section is not accepted, other unknown keys fail the strict decode
+func rejectPolicies(unmarshal func(interface{}) error) error {
+	var sections struct {
+		Policies interface{} `json:"policies" yaml:"policies"`
+	}
+	if unmarshal(&sections) == nil && sections.Policies != nil {
+		return errors.New("topology policies are not supported, AMQP cannot declare them, " +
+			"set them with rabbitmqctl or the management API")
+	}
+	return nil
+}
+
+func (t *Topology) validate() error {
+	exchanges := map[string]bool{}
+	for i, e := range t.Exchanges {
+		if e.Name == "" {
+			return fmt.Errorf("exchange %d has no name", i)
+		}
+		if exchanges[e.Name] {
+			return fmt.Errorf("exchange %s is listed twice", e.Name)
+		}
+		exchanges[e.Name] = true
+		if e.Kind == "" {
+			return fmt.Errorf("exchange %s has no kind", e.Name)
+		}
+		if _, err := toTable(e.Arguments); err != nil {
+			return fmt.Errorf("exchange %s: %w", e.Name, err)
+		}
+	}
+	queues := map[string]bool{}
+	for i, q := range t.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("queue %d has no name", i)
+		}
+		if queues[q.Name] {
+			return fmt.Errorf("queue %s is listed twice", q.Name)
+		}
+		queues[q.Name] = true
+		if _, err := toTable(q.Arguments); err != nil {
+			return fmt.Errorf("queue %s: %w", q.Name, err)
+		}
+	}
+	for i, b := range t.Bindings {
+		if b.Queue == "" || b.Exchange == "" {
+			return fmt.Errorf("binding %d needs a queue and an exchange", i)
+		}
+		if _, err := toTable(b.Arguments); err != nil {
+			return fmt.Errorf("binding %s to %s: %w", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// Exchange returns the exchange with the name
+func (t *Topology) Exchange(name string) (ExchangeSpec, bool) {
+	for _, e := range t.Exchanges {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return ExchangeSpec{}, false
+}
+
+// Queue returns the queue with the name
+func (t *Topology) Queue(name string) (QueueSpec, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return QueueSpec{}, false
+}
+
+// Diff returns what Apply would change without changing anything
+// An existing exchange or queue is checked by declaring it with the same settings which is a no-op
+func (t *Topology) Diff(conn *amqp.Connection) ([]TopologyChange, error) {
+	return t.run(conn, true)
+}
+
+// Apply declares the exchanges, then the queues, then the bindings, declaring what already exists
+// with the same settings is a no-op so Apply can run on every start
+// An exchange or queue that exists with other settings is left as it is and returned as a mismatch,
+// in strict mode Apply stops with an error wrapping a BrokerError instead
+func (t *Topology) Apply(conn *amqp.Connection) ([]TopologyChange, error) {
+	return t.run(conn, false)
+}
+
+func (t *Topology) run(conn *amqp.Connection, dryRun bool) ([]TopologyChange, error) {
+	var changes []TopologyChange
+	// a failed declare closes the channel, every check uses its own
+	check := func(entity, name string, args amqp.Table, passive, declare func(*amqp.Channel) error) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return brokerError(err, nil)
+		}
+		if err := passive(ch); err != nil {
+			if !isAMQPCode(err, amqp.NotFound) {
+				return brokerError(err, args)
+			}
+			changes = append(changes, TopologyChange{Kind: TopologyCreate, Entity: entity, Name: name})
+			if dryRun {
+				return nil
+			}
+			if ch, err = conn.Channel(); err != nil {
+				return brokerError(err, nil)
+			}
+		}
+		err = brokerError(declare(ch), args)
+		if err == nil {
+			return brokerError(ch.Close(), nil)
+		}
+		if !isAMQPCode(err, amqp.PreconditionFailed) {
+			return err
+		}
+		if t.Strict && !dryRun {
+			return fmt.Errorf("%s %s exists with other settings: %w", entity, name, err)
+		}
+		changes = append(changes, TopologyChange{Kind: TopologyMismatch, Entity: entity, Name: name, Detail: amqpReason(err)})
+		return nil
+	}
+
+	for _, e := range t.Exchanges {
+		e := e
+		args, _ := toTable(e.Arguments)
+		err := check("exchange", e.Name, args, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, nil)
+		}, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclare(e.Name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, args)
+		})
+		if err != nil {
+			return changes, err
+		}
+	}
+	for _, q := range t.Queues {
+		q := q
+		args, _ := toTable(q.Arguments)
+		err := check("queue", q.Name, args, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, nil)
+			return err
+		}, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, args)
+			return err
+		})
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return changes, brokerError(err, nil)
+	}
+	defer ch.Close()
+	for _, b := range t.Bindings {
+		name := b.Queue + " to " + b.Exchange
+		changes = append(changes, TopologyChange{Kind: TopologyBind, Entity: "binding", Name: name})
+		if dryRun {
+			continue
+		}
+		args, _ := toTable(b.Arguments)
+		if err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, args); err != nil {
+			return changes, fmt.Errorf("binding %s: %w", name, brokerError(err, args))
+		}
+	}
+	return changes, nil
+}
+
+// WithTopology makes the managers declare their queue or exchange with the settings of the
+// topology entry of the same name, instead of the queue and exchange options
+func WithTopology(t *Topology) Option {
+	return func(o *options) {
+		o.topology = t
+	}
+}
+
+// WithPassive makes the managers check that their named queue and exchange exist instead of declaring them,
+// a missing one fails the constructor with an error matching ErrNotFound
+// Queue, exchange and topology settings are not checked, the fanout receivers still declare their own
+// temporary queue
+func WithPassive() Option {
+	return func(o *options) {
+		o.passive = true
+	}
+}
+
+// declareQueue declares the named queue with its topology entry or the queue options
+func (o *options) declareQueue(ch *amqp.Channel, name string) (amqp.Queue, error) {
+	var topologyQueue *QueueSpec
+	args := o.queueArguments()
+	if o.topology != nil {
+		if q, ok := o.topology.Queue(name); ok {
+			topologyQueue = &q
+			args, _ = toTable(q.Arguments)
+		}
+	}
+	if o.passive {
+		if name == "" {
+			return amqp.Queue{}, errors.New("passive mode needs a queue name")
+		}
+		queue, err := ch.QueueDeclarePassive(name, false, false, false, false, nil)
+		if err != nil {
+			return queue, fmt.Errorf("queue %s must be declared beforehand in passive mode: %w", name, brokerError(err, args))
+		}
+		return queue, nil
+	}
+	if q := topologyQueue; q != nil {
+		queue, err := ch.QueueDeclare(name, q.Durable, q.AutoDelete, q.Exclusive, false, args)
+		return queue, brokerError(err, args)
+	}
+	queue, err := ch.QueueDeclare(
+		name,             // server create the queue name if empty
+		o.queueDurable(), // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		args,             // arguments
+	)
+	return queue, brokerError(err, args)
+}
+
+// declareExchange declares the fanout exchange with its topology entry or the exchange options
+func (o *options) declareExchange(ch *amqp.Channel, name string) error {
+	var topologyExchange *ExchangeSpec
+	args := o.exchangeArguments()
+	if o.topology != nil {
+		if e, ok := o.topology.Exchange(name); ok {
+			topologyExchange = &e
+			args, _ = toTable(e.Arguments)
+		}
+	}
+	if o.passive {
+		if err := ch.ExchangeDeclarePassive(name, "fanout", false, false, false, false, nil); err != nil {
+			return fmt.Errorf("exchange %s must be declared beforehand in passive mode: %w", name, brokerError(err, args))
+		}
+		return nil
+	}
+	if e := topologyExchange; e != nil {
+		return brokerError(ch.ExchangeDeclare(name, e.Kind, e.Durable, e.AutoDelete, e.Internal, false, args), args)
+	}
+	err := ch.ExchangeDeclare(
+		name,
+		"fanout", //kind string,
+		false,    //durable bool,
+		false,    //autoDelete bool,
+		false,    //internal bool,
+		false,    //noWait bool,
+		args)     //args amqp.Table)
+	return brokerError(err, args)
+}
+
+func isAMQPCode(err error, code int) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == code
+}
+
+func amqpReason(err error) string {
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		return amqpErr.Reason
+	}
+	return err.Error()
+}
+
+// toTable converts decoded YAML or JSON arguments to the types amqp.Table supports,
+// JSON numbers become int64 or float64 and nested maps become tables
+func toTable(m map[string]interface{}) (amqp.Table, error) {
+	if m == nil {
+		return nil, nil
+	}
+	table := amqp.Table{}
+	for k, v := range m {
+		value, err := toField(v)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", k, err)
+		}
+		table[k] = value
+	}
+	return table, table.Validate()
+}
+
+func toField(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i, nil
+		}
+		return value.Float64()
+	case int:
+		return int64(value), nil
+	case map[string]interface{}:
+		return toTable(value)
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i := range value {
+			field, err := toField(value[i])
+			if err != nil {
+				return nil, err
+			}
+			list[i] = field
+		}
+		return list, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,198 @@
+package message
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+const testTopologyYAML = `
+strict: true
+exchanges:
+  - name: orders
+    kind: topic
+    durable: true
+queues:
+  - name: orders.created
+    durable: true
+    arguments:
+      x-max-length: 1000
+      x-queue-type: quorum
+bindings:
+  - queue: orders.created
+    exchange: orders
+    key: created.#
+`
+
+const testTopologyJSON = `{
+  "strict": true,
+  "exchanges": [{"name": "orders", "kind": "topic", "durable": true}],
+  "queues": [{"name": "orders.created", "durable": true,
+    "arguments": {"x-max-length": 1000, "x-queue-type": "quorum"}}],
+  "bindings": [{"queue": "orders.created", "exchange": "orders", "key": "created.#"}]
+}`
+
+func TestParseTopology(t *testing.T) {
+	fromYAML, err := ParseTopologyYAML([]byte(testTopologyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := ParseTopologyJSON([]byte(testTopologyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topology := range []*Topology{fromYAML, fromJSON} {
+		q, ok := topology.Queue("orders.created")
+		if !ok || !q.Durable {
+			t.Fatalf("unexpected queue %+v", q)
+		}
+		args, err := toTable(q.Arguments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := amqp.Table{"x-max-length": int64(1000), "x-queue-type": "quorum"}
+		if !reflect.DeepEqual(args, expected) {
+			t.Fatalf("unexpected arguments %#v", args)
+		}
+		if e, ok := topology.Exchange("orders"); !ok || e.Kind != "topic" {
+			t.Fatalf("unexpected exchange %+v", e)
+		}
+		if _, ok := topology.Exchange("missing"); ok {
+			t.Fatal("found a missing exchange")
+		}
+	}
+}
+
+func TestLoadTopology(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "topology.yml")
+	if err := os.WriteFile(path, []byte(testTopologyYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	topology, err := LoadTopology(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !topology.Strict || len(topology.Bindings) != 1 {
+		t.Fatalf("unexpected topology %+v", topology)
+	}
+	if _, err := LoadTopology(filepath.Join(dir, "topology.toml")); err == nil {
+		t.Fatal("expected an error for an unknown file type")
+	}
+}
+
+func TestTopologyValidation(t *testing.T) {
+	for name, data := range map[string]string{
+		"no kind":        "exchanges: [{name: orders}]",
+		"duplicate":      "queues: [{name: a}, {name: a}]",
+		"binding":        "bindings: [{queue: a}]",
+		"unknown field":  "queues: [{name: a, durabel: true}]",
+		"bad argument":   "queues: [{name: a, arguments: {x: {1: 2}}}]",
+		"unnamed queue":  "queues: [{durable: true}]",
+		"unnamed exchng": "exchanges: [{kind: fanout}]",
+	} {
+		if _, err := ParseTopologyYAML([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := ParseTopologyYAML([]byte("policies: [{name: ha, pattern: ^orders}]")); err == nil ||
+		!strings.Contains(err.Error(), "policies are not supported") {
+		t.Errorf("expected policies to be rejected, got %v", err)
+	}
+	if _, err := ParseTopologyJSON([]byte(`{"policies": [{"name": "ha"}]}`)); err == nil ||
+		!strings.Contains(err.Error(), "policies are not supported") {
+		t.Errorf("expected policies to be rejected, got %v", err)
+	}
+	if _, err := ParseTopologyJSON([]byte(`{"queues": [{"name": "a", "durabel": true}]}`)); err == nil {
+		t.Error("expected an unknown JSON field to be rejected")
+	}
+}
+
+func TestTopologyApply(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+	admin, err := NewAdmin(serverAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	queue := t.Name() + "Queue"
+	exchange := t.Name() + "Exchange"
+	admin.QueueDelete(queue, false, false)
+	admin.ExchangeDelete(exchange, false)
+
+	topology := &Topology{
+		Exchanges: []ExchangeSpec{{Name: exchange, Kind: "topic"}},
+		Queues:    []QueueSpec{{Name: queue, Arguments: map[string]interface{}{"x-max-length": 10}}},
+		Bindings:  []BindingSpec{{Queue: queue, Exchange: exchange, Key: "a.#"}},
+	}
+	changes, err := topology.Diff(admin.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 || changes[0].Kind != TopologyCreate || changes[1].Kind != TopologyCreate {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+	if _, err := topology.Apply(admin.conn); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = topology.Apply(admin.conn)
+	if err != nil || len(changes) != 1 || changes[0].Kind != TopologyBind {
+		t.Fatalf("expected applying again to be a no-op, got %v %v", changes, err)
+	}
+
+	topology.Queues[0].Arguments["x-max-length"] = 20
+	changes, err = topology.Diff(admin.conn)
+	if err != nil || changes[0].Kind != TopologyMismatch {
+		t.Fatalf("expected a mismatch, got %v %v", changes, err)
+	}
+	topology.Strict = true
+	_, err = topology.Apply(admin.conn)
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("expected a precondition failure in strict mode, got %v", err)
+	}
+	var brokerErr *BrokerError
+	if !errors.As(err, &brokerErr) || brokerErr.Arguments["x-max-length"] != int64(20) {
+		t.Fatalf("expected a BrokerError with the declared arguments, got %v", err)
+	}
+
+	// managers declare the queue with the topology settings
+	topology.Queues[0].Arguments["x-max-length"] = 10
+	nqm, err := NewNamedQueueManager(serverAddress, queue, WithTopology(topology))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nqm.Close()
+}
+
+func TestPassive(t *testing.T) {
+	err := setup(t.Name(), false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = NewSendNamedQueueManager(serverAddress, t.Name()+"Missing", WithPassive())
+	if !errors.Is(err, ErrNotFound) || Retryable(err) {
+		t.Fatalf("expected ErrNotFound for a missing queue, got %v", err)
+	}
+
+	// setup declared the queue, the settings are not checked
+	nqs, err := NewSendNamedQueueManager(serverAddress, t.Name(), WithPassive(), WithMaxPriority(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nqs.Close()
+	if err := nqs.Send([]byte("passive")); err != nil {
+		t.Fatal(err)
+	}
+	waitExpectedCount(t.Name(), 1)
+}
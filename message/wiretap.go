@@ -0,0 +1,166 @@
+package message
+
+import (
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+)
+
+// Headers added to mirrored messages
+const (
+	// WiretapSourceHeader holds the queue or exchange the message was seen on
+	WiretapSourceHeader = "x-wiretap-source"
+	// WiretapDirectionHeader is WiretapPublish or WiretapConsume
+	WiretapDirectionHeader = "x-wiretap-direction"
+)
+
+// Values of WiretapDirectionHeader
+const (
+	WiretapPublish = "publish"
+	WiretapConsume = "consume"
+)
+
+const defaultWiretapBufferSize = 256
+
+// WiretapConfig configures what a Wiretap mirrors and where
+type WiretapConfig struct {
+	// Exchange is the debug fanout the copies are published to, it is declared if missing
+	Exchange string
+	// SampleRate is the fraction of messages mirrored, 0 mirrors every message
+	SampleRate float64
+	// Headers only mirrors messages that have all of these header values
+	Headers amqp.Table
+	// BufferSize is the number of copies waiting to be published before new ones are dropped
+	BufferSize int
+}
+
+// Wiretap copies messages published or consumed by managers to a debug fanout exchange
+// It has its own connection and never blocks or fails the manager, copies are dropped instead
+// Pass it to managers with WithWiretap, one wiretap can be shared by several managers
+type Wiretap struct {
+	config  WiretapConfig
+	channel *amqp.Channel
+	copies  chan *amqp.Publishing
+	dropped uint64
+	done    chan struct{}
+	once    sync.Once
+	options *options
+}
+
+// NewWiretap connects to the server and declares the debug exchange
+func NewWiretap(serverAddress string, config WiretapConfig, opts ...Option) (*Wiretap, error) {
+	w := newWiretap(config, opts)
+	if w.options.err != nil {
+		return nil, w.options.err
+	}
+	conn, err := w.options.dial(serverAddress)
+	if err != nil {
+		w.options.logger.Error("Failed to connect to RabbitMQ", FieldError, err)
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		w.options.logger.Error("Failed to open a channel", FieldError, err)
+		conn.Close()
+		return nil, brokerError(err, nil)
+	}
+	err = w.options.declareExchange(ch, config.Exchange)
+	if err != nil {
+		w.options.logger.Error("Failed to declare exchange", FieldExchange, config.Exchange, FieldError, err)
+		conn.Close()
+		return nil, err
+	}
+	w.channel = ch
+	go w.publish(conn)
+	return w, nil
+}
+
+func newWiretap(config WiretapConfig, opts []Option) *Wiretap {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultWiretapBufferSize
+	}
+	return &Wiretap{
+		config:  config,
+		copies:  make(chan *amqp.Publishing, config.BufferSize),
+		done:    make(chan struct{}),
+		options: newOptions(opts),
+	}
+}
+
+// Dropped returns the number of copies dropped because the buffer was full
+func (w *Wiretap) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close stops mirroring and closes the connection, copies still buffered are discarded
+func (w *Wiretap) Close() error {
+	w.once.Do(func() {
+		close(w.done)
+	})
+	return nil
+}
+
+// tap queues a copy of msg if it is selected, safe to call on a nil wiretap
+func (w *Wiretap) tap(msg *amqp.Publishing, source, direction string) {
+	if w == nil || !w.selects(msg.Headers) {
+		return
+	}
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	headers := make(amqp.Table, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[WiretapSourceHeader] = source
+	headers[WiretapDirectionHeader] = direction
+	mirrored := *msg
+	mirrored.Headers = headers
+
+	select {
+	case w.copies <- &mirrored:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// tapDelivery is tap for a consumed message
+func (w *Wiretap) tapDelivery(d *amqp.Delivery, source string) {
+	if w == nil {
+		return
+	}
+	w.tap(NewRecord(d).Publishing(), source, WiretapConsume)
+}
+
+// selects applies the header filter and the sample rate
+func (w *Wiretap) selects(headers amqp.Table) bool {
+	for k, v := range w.config.Headers {
+		if !reflect.DeepEqual(headers[k], v) {
+			return false
+		}
+	}
+	rate := w.config.SampleRate
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+func (w *Wiretap) publish(conn *amqp.Connection) {
+	defer conn.Close()
+	for {
+		select {
+		case <-w.done:
+			return
+		case msg := <-w.copies:
+			err := w.channel.Publish(w.config.Exchange, "", false, false, *msg)
+			if err != nil {
+				w.options.logger.Warn("Failed to mirror message", FieldExchange, w.config.Exchange,
+					FieldMessageID, msg.MessageId, FieldError, err)
+			}
+		}
+	}
+}
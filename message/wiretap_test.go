@@ -0,0 +1,52 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestWiretapHeaderFilter(t *testing.T) {
+	w := newWiretap(WiretapConfig{Headers: amqp.Table{"tenant": "a"}}, nil)
+	w.tap(&amqp.Publishing{Headers: amqp.Table{"tenant": "b"}}, "q", WiretapPublish)
+	w.tap(&amqp.Publishing{}, "q", WiretapPublish)
+	if len(w.copies) != 0 {
+		t.Fatalf("expected no copies, got %d", len(w.copies))
+	}
+
+	original := &amqp.Publishing{Headers: amqp.Table{"tenant": "a"}, Body: []byte("x")}
+	w.tap(original, "q", WiretapPublish)
+	if len(w.copies) != 1 {
+		t.Fatalf("expected 1 copy, got %d", len(w.copies))
+	}
+	mirrored := <-w.copies
+	if mirrored.Headers[WiretapSourceHeader] != "q" || mirrored.Headers[WiretapDirectionHeader] != WiretapPublish {
+		t.Errorf("unexpected headers %v", mirrored.Headers)
+	}
+	if _, ok := original.Headers[WiretapSourceHeader]; ok {
+		t.Error("original headers were modified")
+	}
+}
+
+func TestWiretapDropsWhenFull(t *testing.T) {
+	w := newWiretap(WiretapConfig{BufferSize: 2}, nil)
+	for i := 0; i < 5; i++ {
+		w.tap(&amqp.Publishing{}, "q", WiretapPublish)
+	}
+	if len(w.copies) != 2 || w.Dropped() != 3 {
+		t.Errorf("unexpected buffered/dropped %d/%d", len(w.copies), w.Dropped())
+	}
+
+	var nilTap *Wiretap
+	nilTap.tap(&amqp.Publishing{}, "q", WiretapPublish)
+}
+
+func TestWiretapSampleRate(t *testing.T) {
+	w := newWiretap(WiretapConfig{SampleRate: 0.1, BufferSize: 10000}, nil)
+	for i := 0; i < 10000; i++ {
+		w.tap(&amqp.Publishing{}, "q", WiretapPublish)
+	}
+	if n := len(w.copies); n < 700 || n > 1300 {
+		t.Errorf("expected about 1000 copies, got %d", n)
+	}
+}